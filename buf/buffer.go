@@ -3,14 +3,23 @@ package buf
 
 import "strings"
 
+// Buffer is a view into a line of text. It keeps track of where the view
+// starts in the original line so positions can be reported as the line is
+// consumed.
 type Buffer struct {
-	s string
+	s   string
+	off int
 }
 
 func NewBuffer(s string) Buffer {
 	return Buffer{s: s}
 }
 
+// Offset returns the index in the original line where the buffer starts.
+func (b Buffer) Offset() int {
+	return b.off
+}
+
 func (b Buffer) String() string {
 	return b.s
 }
@@ -18,12 +27,12 @@ func (b Buffer) String() string {
 // Advance the buffer by i characters. Returns the new buffer with the initial
 // characters dropped.
 func (b Buffer) Advance(i int) Buffer {
-	return Buffer{s: b.s[i:]}
+	return Buffer{s: b.s[i:], off: b.off + i}
 }
 
 // Truncates a buffer to i characters long. Returns the new truncated buffer.
 func (b Buffer) Trunc(i int) Buffer {
-	return Buffer{s: b.s[:i]}
+	return Buffer{s: b.s[:i], off: b.off}
 }
 
 func (b Buffer) IsEmpty() bool {
@@ -63,6 +72,14 @@ func Str(in string) Compare {
 	}
 }
 
+// Creates a Compare function that checks if the current start of the buffer
+// matches the string in, ignoring differences in case.
+func StrFold(in string) Compare {
+	return func(s string) bool {
+		return len(s) >= len(in) && strings.EqualFold(s[:len(in)], in)
+	}
+}
+
 // A Compare function that matches whitespace
 func Whitespace(s string) bool {
 	return s[0] == ' ' || s[0] == '\t'
@@ -78,6 +95,18 @@ func Letter(s string) bool {
 	return (s[0] >= 'a' && s[0] <= 'z') || (s[0] >= 'A' && s[0] <= 'Z')
 }
 
+// A Compare function for the first character of an identifier, which is a
+// letter or underscore
+func IdentifierStart(s string) bool {
+	return Letter(s) || s[0] == '_'
+}
+
+// A Compare function for the characters allowed in an identifier after the
+// first, letters, digits and underscores
+func IdentifierChar(s string) bool {
+	return IdentifierStart(s) || Digit(s)
+}
+
 // A Compare function that looks for any digit 0-9
 func Digit(s string) bool {
 	return s[0] >= '0' && s[0] <= '9'
@@ -123,3 +152,13 @@ func (b Buffer) TakeUntil(fn Compare) (taken Buffer, left Buffer) {
 	left = b.Advance(i)
 	return
 }
+
+// Take an identifier from the start of the buffer, a letter or underscore
+// followed by any number of letters, digits and underscores. If the buffer
+// doesn't start with an identifier taken is empty.
+func (b Buffer) TakeIdentifier() (taken Buffer, left Buffer) {
+	if !b.StartsWith(IdentifierStart) {
+		return b.Trunc(0), b
+	}
+	return b.TakeWhile(IdentifierChar)
+}
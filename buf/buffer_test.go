@@ -22,7 +22,7 @@ func TestBufferStartChar(t *testing.T) {
 		},
 	}
 	for _, tc := range tests {
-		b := Buffer{tc.input}
+		b := Buffer{s: tc.input}
 		require.Equal(t, tc.expected, b.StartsWith(Char(tc.check)))
 	}
 }
@@ -44,11 +44,37 @@ func TestBufferStartString(t *testing.T) {
 		},
 	}
 	for _, tc := range tests {
-		b := Buffer{tc.input}
+		b := Buffer{s: tc.input}
 		require.Equal(t, tc.expected, b.StartsWith(Str(tc.check)))
 	}
 }
 
+func TestBufferStartStringFold(t *testing.T) {
+	tests := []struct {
+		input    string
+		check    string
+		expected bool
+	}{
+		{
+			input:    ",x)",
+			check:    ",X)",
+			expected: true,
+		}, {
+			input:    ",Y",
+			check:    ",y",
+			expected: true,
+		}, {
+			input:    ",",
+			check:    ",X",
+			expected: false,
+		},
+	}
+	for _, tc := range tests {
+		b := Buffer{s: tc.input}
+		require.Equal(t, tc.expected, b.StartsWith(StrFold(tc.check)))
+	}
+}
+
 func TestBufferScanChar(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -70,7 +96,7 @@ func TestBufferScanChar(t *testing.T) {
 		},
 	}
 	for _, tc := range tests {
-		b := Buffer{tc.input}
+		b := Buffer{s: tc.input}
 		require.Equal(t, tc.expected, b.Scan(Char(tc.check)))
 	}
 }
@@ -111,3 +137,33 @@ func TestBufferTakeWhile(t *testing.T) {
 		require.Equal(t, tc.expectedLeft, left.String())
 	}
 }
+
+func TestBufferOffset(t *testing.T) {
+	b := NewBuffer("  LDA #1")
+	require.Equal(t, 0, b.Offset())
+	_, left := b.TakeWhile(Whitespace)
+	require.Equal(t, 2, left.Offset())
+	op, left := left.TakeWhile(Letter)
+	require.Equal(t, 2, op.Offset())
+	require.Equal(t, 5, left.Offset())
+	require.Equal(t, 7, left.Advance(2).Offset())
+	require.Equal(t, 5, left.Trunc(1).Offset())
+}
+
+func TestBufferTakeIdentifier(t *testing.T) {
+	tests := []struct {
+		input string
+		taken string
+		left  string
+	}{
+		{input: "loop1 rest", taken: "loop1", left: " rest"},
+		{input: "_tmp+1", taken: "_tmp", left: "+1"},
+		{input: "1abc", taken: "", left: "1abc"},
+		{input: "", taken: "", left: ""},
+	}
+	for _, tc := range tests {
+		taken, left := NewBuffer(tc.input).TakeIdentifier()
+		require.Equal(t, tc.taken, taken.String())
+		require.Equal(t, tc.left, left.String())
+	}
+}
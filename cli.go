@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mikerowehl/asm/buf"
+	"github.com/mikerowehl/asm/expr"
+)
+
+// version is reported by --version, and can be set at build time with
+// -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+// Exit codes returned by run.
+const (
+	exitOK       = 0
+	exitAssembly = 1 // Errors in the source
+	exitUsage    = 2 // Bad command line
+	exitIO       = 3 // Couldn't read or write a file
+)
+
+// outputFormat is a way of writing out the assembled program.
+type outputFormat struct {
+	ext   string
+	flat  bool // The format is one block of memory, so gaps need filling
+	write func(w io.Writer, segs []binaryChunk, opts outputOptions) error
+}
+
+var outputFormats = map[string]outputFormat{
+	"prg": {ext: ".prg", flat: true, write: writeFlatProgram},
+	"bin": {ext: ".bin", flat: true, write: writeRaw},
+	"hex": {ext: ".hex", write: writeIntelHex},
+	"s19": {ext: ".s19", write: func(w io.Writer, segs []binaryChunk, opts outputOptions) error {
+		return writeSRecord(w, segs, opts, 2)
+	}},
+	"s28": {ext: ".s28", write: func(w io.Writer, segs []binaryChunk, opts outputOptions) error {
+		return writeSRecord(w, segs, opts, 3)
+	}},
+}
+
+func formatNames() string {
+	names := []string{}
+	for name := range outputFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// stringList is a flag that can be given more than once, collecting every
+// value.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// parseValue evaluates a number or constant expression given on the command
+// line, like $0801 or 49152.
+func parseValue(s string) (int, error) {
+	p := expr.Parser{}
+	e, remain, err := p.Parse(buf.NewBuffer(s))
+	if err != nil {
+		return 0, err
+	}
+	if !remain.IsEmpty() {
+		return 0, fmt.Errorf("unexpected text %v", remain.String())
+	}
+	return evaluate(e, map[string]int{})
+}
+
+// parseDefine splits a -D option into the name and value. A name on its own
+// is defined as 1.
+func parseDefine(s string) (name string, val int, err error) {
+	name, value, found := strings.Cut(s, "=")
+	if name == "" {
+		return "", 0, fmt.Errorf("missing name in -D %s", s)
+	}
+	if !found {
+		return name, 1, nil
+	}
+	val, err = parseValue(value)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad value for -D %s: %v", s, err)
+	}
+	return name, val, nil
+}
+
+// defaultOutput picks the output filename when -o isn't given, which is the
+// input with the extension for the format. Source from stdin goes to out.
+func defaultOutput(input string, ext string) string {
+	if input == "-" {
+		return "out" + ext
+	}
+	return strings.TrimSuffix(input, filepath.Ext(input)) + ext
+}
+
+// createAndWrite creates filename and writes to it using fn.
+func createAndWrite(filename string, fn func(w io.Writer) error) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err = fn(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// run is the command line interface. It returns the exit code for the
+// process.
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("asm", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: asm [flags] file.asm\n\nUse - as the file to read source from stdin.\n\n")
+		flags.PrintDefaults()
+	}
+	var defines, includeDirs stringList
+	output := flags.String("o", "", "write the program to `file` (default is the input name with the format extension)")
+	format := flags.String("format", "prg", "output `format`, one of "+formatNames())
+	flags.Var(&defines, "D", "predefine a symbol as `NAME=VALUE`, or NAME for 1 (repeatable)")
+	flags.Var(&includeDirs, "I", "search `dir` for included files (repeatable)")
+	org := flags.String("org", "$C000", "default origin `address` when the source has no .ORG")
+	quiet := flags.Bool("q", false, "only report errors, even with -v")
+	verbose := flags.Bool("v", false, "report what was written")
+	showVersion := flags.Bool("version", false, "print the version and exit")
+	pad := flags.Int("pad", 0, "pad the program with the fill byte to `size` bytes")
+	fill := flags.String("fill", "$FF", "`byte` used for padding and filling gaps")
+	fillGaps := flags.Bool("fill-gaps", false, "fill gaps between .ORG regions in the prg and bin formats instead of failing")
+	recordLen := flags.Int("record-len", 16, "data bytes per record for the hex and S-record formats")
+	rom := flags.String("rom", "", "fail if any code falls outside the ROM window `START:END`")
+	longBranches := flags.Bool("long-branches", false, "rewrite out of range branches as an inverted branch over a JMP")
+	listing := flags.String("l", "", "write an assembly listing to `file`")
+	viceLabels := flags.String("vice-labels", "", "write symbols in VICE monitor label format to `file`")
+	symbolText := flags.String("symbols", "", "write a sorted symbol table to `file`")
+	symbolJSON := flags.String("symbols-json", "", "write the symbol table as JSON to `file`")
+
+	usageError := func(format string, args ...any) int {
+		fmt.Fprintf(stderr, "asm: "+format+"\n", args...)
+		flags.Usage()
+		return exitUsage
+	}
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if *showVersion {
+		fmt.Fprintf(stdout, "asm %s\n", version)
+		return exitOK
+	}
+	if flags.NArg() != 1 {
+		return usageError("expected a single source file")
+	}
+	outFormat, ok := outputFormats[*format]
+	if !ok {
+		return usageError("unknown format %s, expected one of %s", *format, formatNames())
+	}
+	origin, err := parseValue(*org)
+	if err != nil {
+		return usageError("bad --org %s: %v", *org, err)
+	}
+	fillByte, err := parseValue(*fill)
+	if err != nil || fillByte < 0 || fillByte > 0xff {
+		return usageError("bad --fill %s, expected a byte value", *fill)
+	}
+	if *pad < 0 {
+		return usageError("bad --pad %d", *pad)
+	}
+	if *recordLen < 1 || *recordLen > 250 {
+		return usageError("bad --record-len %d, expected 1 to 250", *recordLen)
+	}
+	var romStart, romEnd int
+	if *rom != "" {
+		if romStart, romEnd, err = parseWindow(*rom); err != nil {
+			return usageError("bad --rom %s: %v", *rom, err)
+		}
+	}
+
+	a := assembler{origin: origin, longBranches: *longBranches, includeDirs: includeDirs}
+	for _, d := range defines {
+		name, val, err := parseDefine(d)
+		if err != nil {
+			return usageError("%v", err)
+		}
+		a.predefine(name, val)
+	}
+
+	input := flags.Arg(0)
+	if input == "-" {
+		a.file = "<stdin>"
+		err = a.parseReader(stdin)
+	} else {
+		err = a.parseFile(input)
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		fmt.Fprintf(stderr, "asm: %v\n", err)
+		return exitIO
+	}
+	if err != nil {
+		// Diagnostics are printed one per line without any prefix so
+		// editors can pick up the locations
+		fmt.Fprintln(stderr, err)
+		return exitAssembly
+	}
+	_, err = a.binaryImage()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitAssembly
+	}
+	if *rom != "" {
+		if err = a.checkWindow(romStart, romEnd); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitAssembly
+		}
+	}
+	segs := a.segments()
+	if *pad > 0 {
+		if segs, err = padSegments(segs, a.origin, *pad, uint8(fillByte)); err != nil {
+			fmt.Fprintf(stderr, "asm: %v\n", err)
+			return exitAssembly
+		}
+	}
+	if outFormat.flat && !*fillGaps {
+		if err = checkGaps(segs); err != nil {
+			fmt.Fprintf(stderr, "asm: %v\n", err)
+			return exitAssembly
+		}
+	}
+	opts := outputOptions{origin: a.origin, fill: uint8(fillByte), recordLen: *recordLen}
+
+	if *output == "" {
+		*output = defaultOutput(input, outFormat.ext)
+	}
+	files := []struct {
+		filename string
+		fn       func(w io.Writer) error
+	}{
+		{*output, func(w io.Writer) error { return outFormat.write(w, segs, opts) }},
+		{*listing, a.writeListing},
+		{*viceLabels, a.writeViceLabels},
+		{*symbolText, a.writeSymbolText},
+		{*symbolJSON, a.writeSymbolJSON},
+	}
+	for _, f := range files {
+		if f.filename == "" {
+			continue
+		}
+		if err = createAndWrite(f.filename, f.fn); err != nil {
+			fmt.Fprintf(stderr, "asm: %v\n", err)
+			return exitIO
+		}
+	}
+	if *verbose && !*quiet {
+		size := 0
+		for _, seg := range segs {
+			size += len(seg.mem)
+		}
+		fmt.Fprintf(stdout, "wrote %d bytes at $%04X to %s\n", size, a.origin, *output)
+	}
+	return exitOK
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func runCLI(args []string, stdin string) (code int, stdout string, stderr string) {
+	var out, errOut strings.Builder
+	code = run(args, strings.NewReader(stdin), &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+func TestRunWritesProgram(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "border.asm")
+	require.Nil(t, os.WriteFile(src, []byte(" lda #COLOR\n sta $d020\n rts\n"), 0o644))
+
+	code, stdout, stderr := runCLI([]string{"-v", "-D", "COLOR=$0e", src}, "")
+	require.Equal(t, exitOK, code, stderr)
+	out := filepath.Join(dir, "border.prg")
+	require.Equal(t, "wrote 6 bytes at $C000 to "+out+"\n", stdout)
+	prg, err := os.ReadFile(out)
+	require.Nil(t, err)
+	require.Equal(t, []uint8{0x00, 0xc0, 0xa9, 0x0e, 0x8d, 0x20, 0xd0, 0x60}, prg)
+}
+
+func TestRunQuiet(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "x.prg")
+	code, stdout, stderr := runCLI([]string{"-v", "-q", "-o", out, "-"}, " RTS\n")
+	require.Equal(t, exitOK, code, stderr)
+	require.Equal(t, "", stdout)
+	require.Equal(t, "", stderr)
+}
+
+func TestRunStdin(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "x.prg")
+	code, _, stderr := runCLI([]string{"--org", "$0801", "-D", "FLAG", "-o", out, "-"}, " .BYTE FLAG\n")
+	require.Equal(t, exitOK, code, stderr)
+	prg, err := os.ReadFile(out)
+	require.Nil(t, err)
+	require.Equal(t, []uint8{0x01, 0x08, 0x01}, prg)
+}
+
+func TestRunRawPadded(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "rom.bin")
+	args := []string{"--format", "bin", "--org", "$E000", "--pad", "8", "--fill", "$EA", "--rom", "$E000:$FFFF", "-o", out, "-"}
+	code, _, stderr := runCLI(args, " LDA #1\n RTS\n")
+	require.Equal(t, exitOK, code, stderr)
+	rom, err := os.ReadFile(out)
+	require.Nil(t, err)
+	require.Equal(t, []uint8{0xa9, 0x01, 0x60, 0xea, 0xea, 0xea, 0xea, 0xea}, rom)
+
+	args = []string{"--format", "bin", "--rom", "$E000:$FFFF", "-o", out, "-"}
+	code, _, stderr = runCLI(args, " .ORG $DFFF\n RTS\n")
+	require.Equal(t, exitAssembly, code)
+	require.Contains(t, stderr, "outside the ROM window")
+
+	args = []string{"--format", "bin", "--pad", "1", "-o", out, "-"}
+	code, _, _ = runCLI(args, " LDA #1\n")
+	require.Equal(t, exitAssembly, code)
+
+	args = []string{"--fill", "$100", "-o", out, "-"}
+	code, _, _ = runCLI(args, "")
+	require.Equal(t, exitUsage, code)
+}
+
+func TestRunIntelHexSparse(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "rom.hex")
+	args := []string{"--format", "hex", "--record-len", "2", "-o", out, "-"}
+	code, _, stderr := runCLI(args, " .ORG $E000\n LDA #1\n RTS\n .ORG $FFFC\n .WORD $E000\n")
+	require.Equal(t, exitOK, code, stderr)
+	hex, err := os.ReadFile(out)
+	require.Nil(t, err)
+	require.Equal(t, ":02E00000A90174\n:01E0020060BD\n:02FFFC0000E023\n:00000001FF\n", string(hex))
+}
+
+func TestRunGaps(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "x.prg")
+	src := " .ORG $1000\n RTS\n .ORG $1003\n NOP\n"
+	code, _, stderr := runCLI([]string{"-o", out, "-"}, src)
+	require.Equal(t, exitAssembly, code)
+	require.Contains(t, stderr, "gap in the program at $1001-$1002")
+
+	code, _, stderr = runCLI([]string{"--fill-gaps", "--fill", "0", "-o", out, "-"}, src)
+	require.Equal(t, exitOK, code, stderr)
+	prg, err := os.ReadFile(out)
+	require.Nil(t, err)
+	require.Equal(t, []uint8{0x00, 0x10, 0x60, 0x00, 0x00, 0xea}, prg)
+}
+
+func TestRunConditionalDefines(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "x.bin")
+	src := " .IFDEF PAL\n .BYTE 50\n .ELSE\n .BYTE 60\n .ENDIF\n"
+	for _, tc := range []struct {
+		args     []string
+		expected uint8
+	}{
+		{[]string{"-D", "PAL"}, 50},
+		{[]string{}, 60},
+	} {
+		args := append(tc.args, "--format", "bin", "-o", out, "-")
+		code, _, stderr := runCLI(args, src)
+		require.Equal(t, exitOK, code, stderr)
+		bin, err := os.ReadFile(out)
+		require.Nil(t, err)
+		require.Equal(t, []uint8{tc.expected}, bin)
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "x.prg")
+	tests := []struct {
+		args   []string
+		stdin  string
+		code   int
+		stderr string
+	}{
+		{args: []string{}, code: exitUsage, stderr: "expected a single source file"},
+		{args: []string{"--bogus", "-"}, code: exitUsage},
+		{args: []string{"--format", "tap", "-"}, code: exitUsage, stderr: "unknown format tap"},
+		{args: []string{"--org", "$zz", "-"}, code: exitUsage, stderr: "bad --org"},
+		{args: []string{"-D", "=3", "-"}, code: exitUsage, stderr: "missing name"},
+		{args: []string{"--record-len", "0", "-"}, code: exitUsage, stderr: "bad --record-len"},
+		{args: []string{filepath.Join(dir, "missing.asm")}, code: exitIO},
+		{args: []string{"-o", out, "-"}, stdin: " STZ $10\n", code: exitAssembly, stderr: "<stdin>:1:2: error: STZ is not a valid instruction"},
+		{args: []string{"-o", out, "-"}, stdin: " JMP nowhere\n", code: exitAssembly, stderr: "undefined symbol: nowhere"},
+		{args: []string{"-o", filepath.Join(dir, "no", "such", "dir.prg"), "-"}, stdin: " RTS\n", code: exitIO},
+	}
+	for _, tc := range tests {
+		code, _, stderr := runCLI(tc.args, tc.stdin)
+		require.Equal(t, tc.code, code, tc.args)
+		require.Contains(t, stderr, tc.stderr, tc.args)
+	}
+}
+
+func TestRunVersion(t *testing.T) {
+	code, stdout, _ := runCLI([]string{"--version"}, "")
+	require.Equal(t, exitOK, code)
+	require.Equal(t, "asm dev\n", stdout)
+}
+
+func TestRunRedefineCommandLineSymbol(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "x.prg")
+	code, _, stderr := runCLI([]string{"-D", "PAL=1", "-o", out, "-"}, "PAL = 0\n")
+	require.Equal(t, exitAssembly, code)
+	require.Contains(t, stderr, "PAL redefined, first defined at command line")
+}
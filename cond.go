@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mikerowehl/asm/buf"
+	"github.com/mikerowehl/asm/expr"
+)
+
+// conditional is an .IF block that's open while parsing.
+type conditional struct {
+	pos     Position // Where the block started
+	parent  bool     // Whether the lines around the block are being assembled
+	active  bool     // Whether the current branch is being assembled
+	taken   bool     // Whether any branch so far has been assembled
+	sawElse bool
+}
+
+// assembling returns true unless the current line is in a branch of a
+// conditional that isn't being assembled.
+func (a *assembler) assembling() bool {
+	return len(a.conds) == 0 || a.conds[len(a.conds)-1].active
+}
+
+// lineOperation splits off any label at the start of a line, returning it
+// along with the operation that follows and whatever is left after that.
+func lineOperation(line buf.Buffer) (label buf.Buffer, op buf.Buffer, remain buf.Buffer) {
+	remain = line
+	if !remain.StartsWith(buf.Whitespace) {
+		label, remain = takeLabel(remain)
+		if remain.StartsWith(buf.Char(':')) {
+			remain = remain.Advance(1)
+		}
+	}
+	remain = remain.Advance(remain.Scan(buf.Whitespace))
+	op, remain = remain.TakeWhile(buf.Word)
+	return
+}
+
+// parseConditional handles the conditional assembly directives, returning
+// true if the line held one:
+//
+//	.IF expr / .IFDEF name / .IFNDEF name
+//	.ELSEIF expr
+//	.ELSE
+//	.ENDIF
+//
+// Conditions are evaluated as the source is parsed, so they can only use
+// symbols with values known at that point, which are constants defined on
+// earlier lines and -D defines. Branches that aren't taken are skipped
+// without being parsed.
+func (a *assembler) parseConditional(line buf.Buffer) (bool, error) {
+	label, op, remain := lineOperation(line)
+	kind, found := PseudoOpMap[strings.ToUpper(op.String())]
+	if !found {
+		return false, nil
+	}
+	switch kind {
+	case PseudoIf, PseudoIfdef, PseudoIfndef, PseudoElseif, PseudoElse, PseudoEndif:
+	default:
+		return false, nil
+	}
+	directive := strings.ToUpper(op.String())
+	// The directive still takes effect with a label, so the error doesn't
+	// cause more about unmatched blocks
+	var labelErr error
+	if !label.IsEmpty() && a.assembling() {
+		labelErr = errorfAt(label, "labels can't be used on %s lines", directive)
+	}
+
+	var cond *conditional
+	if kind != PseudoIf && kind != PseudoIfdef && kind != PseudoIfndef {
+		if len(a.conds) == 0 {
+			return true, errorfAt(op, "%s without .IF", directive)
+		}
+		cond = &a.conds[len(a.conds)-1]
+		if cond.sawElse && kind != PseudoEndif {
+			return true, errorfAt(op, "%s after .ELSE", directive)
+		}
+	}
+
+	switch kind {
+	case PseudoIf, PseudoIfdef, PseudoIfndef:
+		c := conditional{pos: a.position(op), parent: a.assembling()}
+		if c.parent {
+			val, err := a.condition(kind, remain)
+			if err != nil {
+				// Skip the whole block, including any .ELSEIF and .ELSE, so
+				// one bad condition doesn't cause errors all the way to the
+				// .ENDIF
+				c.taken = true
+				a.conds = append(a.conds, c)
+				return true, err
+			}
+			c.active, c.taken = val, val
+		}
+		a.conds = append(a.conds, c)
+	case PseudoElseif:
+		cond.active = false
+		if cond.parent && !cond.taken {
+			val, err := a.condition(kind, remain)
+			if err != nil {
+				cond.taken = true
+				return true, err
+			}
+			cond.active, cond.taken = val, val
+		}
+	case PseudoElse:
+		cond.sawElse = true
+		cond.active = cond.parent && !cond.taken
+		cond.taken = true
+		if labelErr == nil {
+			labelErr = a.checkEnd(remain)
+		}
+	case PseudoEndif:
+		a.conds = a.conds[:len(a.conds)-1]
+		if labelErr == nil {
+			labelErr = a.checkEnd(remain)
+		}
+	}
+	return true, labelErr
+}
+
+// checkEnd makes sure there's nothing but a comment left on the line.
+func (a *assembler) checkEnd(remain buf.Buffer) error {
+	remain = remain.Advance(remain.Scan(buf.Whitespace))
+	if !remain.IsEmpty() && !remain.StartsWith(buf.Char(';')) {
+		return errorfAt(remain, "unexpected text %v", remain.String())
+	}
+	return nil
+}
+
+// condition works out whether the branch of a conditional is taken.
+func (a *assembler) condition(kind PseudoOpKind, line buf.Buffer) (bool, error) {
+	line = line.Advance(line.Scan(buf.Whitespace))
+	if kind == PseudoIfdef || kind == PseudoIfndef {
+		name, remain := takeSymbol(line)
+		if name.IsEmpty() {
+			return false, errorfAt(line, "expected a symbol name")
+		}
+		if err := a.checkEnd(remain); err != nil {
+			return false, err
+		}
+		_, found := a.defs[a.rename(name.String())]
+		return found == (kind == PseudoIfdef), nil
+	}
+	if line.IsEmpty() || line.StartsWith(buf.Char(';')) {
+		return false, errorfAt(line, "missing condition")
+	}
+	val, remain, err := a.evaluateNow(line, "conditions")
+	if err != nil {
+		return false, err
+	}
+	if err := a.checkEnd(remain); err != nil {
+		return false, err
+	}
+	return val != 0, nil
+}
+
+// evaluateNow parses an expression and evaluates it straight away, for
+// directives that need a value while the source is being parsed. Only
+// symbols with values known at this point can be used, use describes what
+// the value is for in the errors about ones that can't.
+func (a *assembler) evaluateNow(line buf.Buffer, use string) (int, buf.Buffer, error) {
+	e, remain, err := a.exprParser.Parse(line)
+	if err != nil {
+		return 0, remain, errorAt(line, err)
+	}
+	text := line.Trunc(len(line.String()) - len(remain.String()))
+	val, err := evaluate(e, a.known)
+	var undef *expr.UndefinedSymbolError
+	if errors.As(err, &undef) {
+		if undef.Name == expr.ProgramCounter {
+			return 0, remain, errorfAt(text, "the program counter isn't known yet, %s can't use it", use)
+		}
+		if _, found := a.defs[undef.Name]; found {
+			return 0, remain, errorfAt(text, "%s has no value yet, %s can only use constants defined before them", undef.Name, use)
+		}
+		return 0, remain, errorfAt(text, "%s is not defined, %s can't refer to symbols defined later", undef.Name, use)
+	}
+	if err != nil {
+		return 0, remain, errorAt(text, err)
+	}
+	return val, remain, nil
+}
+
+// checkConditionals reports every .IF opened since depth that's still
+// missing its .ENDIF, and closes them.
+func (a *assembler) checkConditionals(depth int) Diagnostics {
+	var diags Diagnostics
+	for _, c := range a.conds[depth:] {
+		diags = append(diags, diagnosticAt(c.pos, fmt.Errorf("missing .ENDIF")))
+	}
+	a.conds = a.conds[:depth]
+	return diags
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConditionals(t *testing.T) {
+	src := `LINES = 312
+ .IF PAL && LINES == 312
+ .BYTE 1
+ .ELSEIF NTSC
+ .BYTE 2
+ .ELSE
+ .BYTE 3
+ .ENDIF
+ .IFDEF DEBUG
+ .BYTE 4
+ .ENDIF
+ .IF 0
+ .IF undefined == 1 ; not evaluated in a skipped block
+ .ENDIF
+ .ENDIF
+ .IFNDEF DEBUG
+ .BYTE 5
+ .ENDIF
+`
+	testCases := []struct {
+		defines  map[string]int
+		expected []uint8
+	}{
+		{map[string]int{"PAL": 1}, []uint8{1, 5}},
+		{map[string]int{"PAL": 0, "NTSC": 1}, []uint8{2, 5}},
+		{map[string]int{"PAL": 0, "NTSC": 0, "DEBUG": 0}, []uint8{3, 4}},
+	}
+	for _, tc := range testCases {
+		a := assembler{}
+		for name, val := range tc.defines {
+			a.predefine(name, val)
+		}
+		require.Nil(t, a.parseReader(strings.NewReader(src)), tc.defines)
+		bytes, err := a.binaryImage()
+		require.Nil(t, err, tc.defines)
+		require.Equal(t, tc.expected, bytes, tc.defines)
+	}
+}
+
+func TestNestedConditionals(t *testing.T) {
+	src := `A = 1
+B = 0
+ .IF A
+ .IF B
+ .BYTE 1
+ .ELSE
+ .BYTE 2
+ .ENDIF
+ .ELSE
+ .IF 1
+ .BYTE 3
+ .ENDIF
+ .ENDIF
+ .IFDEF B
+ .BYTE 4
+ .ENDIF
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{2, 4}, bytes)
+}
+
+func TestConditionalInMacro(t *testing.T) {
+	src := ` .MACRO border color
+ .IF \color < 16
+ LDA #\color
+ .ELSE
+ LDA #0
+ .ENDIF
+ .ENDM
+ border 5
+ border 20
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{0xa9, 0x05, 0xa9, 0x00}, bytes)
+}
+
+func TestConditionalErrors(t *testing.T) {
+	testCases := []struct {
+		src      string
+		expected string
+	}{
+		{" .ENDIF\n", "1:2: error: .ENDIF without .IF"},
+		{" .ELSE\n", "1:2: error: .ELSE without .IF"},
+		{" .IF 1\n .ELSE\n .ELSEIF 1\n .ENDIF\n", "3:2: error: .ELSEIF after .ELSE"},
+		{" .IF 1\n NOP\n", "1:2: error: missing .ENDIF"},
+		{" .IF\n .ENDIF\n", "1:5: error: missing condition"},
+		{" .IF 1 2\n .ENDIF\n", "1:8: error: unexpected text 2"},
+		{" .IF LATER\n .ENDIF\nLATER = 1\n", "1:6: error: LATER is not defined, conditions can't refer to symbols defined later"},
+		{"start NOP\n .IF start > 0\n .ENDIF\n", "2:6: error: start has no value yet, conditions can only use constants defined before them"},
+		{"x .IF 1\n .ENDIF\n", "1:1: error: labels can't be used on .IF lines"},
+		{" .IF 1\nx .ENDIF\n", "2:1: error: labels can't be used on .ENDIF lines"},
+		{" .IFDEF\n .ENDIF\n", "1:8: error: expected a symbol name"},
+		{" .IF 1\n .ENDIF 3\n", "2:9: error: unexpected text 3"},
+		{" .IF LATER\n STZ $10\n .ENDIF\n", "1:6: error: LATER is not defined, conditions can't refer to symbols defined later"},
+		{" .IF nope\n .ELSE\n XYZ\n .ENDIF\n", "1:6: error: nope is not defined, conditions can't refer to symbols defined later"},
+		{" .IFDEF 1\n .ELSEIF 1\n XYZ\n .ELSE\n XYZ\n .ENDIF\n", "1:9: error: expected a symbol name"},
+	}
+	for _, tc := range testCases {
+		a := assembler{}
+		err := a.parseReader(strings.NewReader(tc.src))
+		require.NotNil(t, err, tc.src)
+		require.Equal(t, tc.expected, err.Error(), tc.src)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mikerowehl/asm/buf"
+)
+
+// Position is a location in the source. Lines and columns both count from 1.
+// A Line of 0 means the position is only a name for somewhere outside the
+// source, like the command line.
+type Position struct {
+	File      string
+	Line      int
+	Col       int
+	Expansion *Expansion // The macro call the line came from, if any
+}
+
+// Expansion is a macro call, recorded in the position of every line expanded
+// from it.
+type Expansion struct {
+	Macro string
+	Call  Position
+}
+
+func (p Position) String() string {
+	if p.Line == 0 {
+		return p.File
+	}
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+	SeverityNote
+)
+
+var SeverityStrings = []string{
+	"error",
+	"warning",
+	"note",
+}
+
+func (s Severity) String() string {
+	return SeverityStrings[s]
+}
+
+// Diagnostic is a problem found in the source. EndCol is the column just
+// past the end of the text the problem covers, or 0 if only the starting
+// column is known.
+type Diagnostic struct {
+	Pos      Position
+	EndCol   int
+	Severity Severity
+	Message  string
+	err      error // The error the diagnostic was made from, if any
+}
+
+// Error formats the diagnostic the way GCC does, so editors can jump to the
+// location. Problems in lines expanded from a macro are followed by a note for
+// each call the line came through:
+//
+//	border.asm:3:2: error: STZ is not a valid instruction
+//	macros.asm:7:2: error: value 300 does not fit in 8 bits
+//	border.asm:12:2: note: in expansion of macro setcolor
+func (d Diagnostic) Error() string {
+	s := fmt.Sprintf("%s: %s: %s", d.Pos, d.Severity, d.Message)
+	for e := d.Pos.Expansion; e != nil; e = e.Call.Expansion {
+		s += fmt.Sprintf("\n%s: %s: in expansion of macro %s", e.Call, SeverityNote, e.Macro)
+	}
+	return s
+}
+
+func (d Diagnostic) Unwrap() error {
+	return d.err
+}
+
+// Diagnostics collects every problem found while assembling, so they can all
+// be reported at once instead of stopping at the first.
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	lines := []string{}
+	for _, diag := range d {
+		lines = append(lines, diag.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// err returns the diagnostics as an error, or nil if there aren't any.
+func (d Diagnostics) err() error {
+	if len(d) == 0 {
+		return nil
+	}
+	return d
+}
+
+// spanError ties an error to the section of the current line held in a
+// buffer, so the diagnostic for it can point at the right columns.
+type spanError struct {
+	col    int // Zero based offsets into the line
+	endCol int
+	err    error
+}
+
+func (e *spanError) Error() string {
+	return e.err.Error()
+}
+
+func (e *spanError) Unwrap() error {
+	return e.err
+}
+
+// errorAt wraps err with the span of the line covered by b.
+func errorAt(b buf.Buffer, err error) error {
+	return &spanError{col: b.Offset(), endCol: b.Offset() + len(b.String()), err: err}
+}
+
+// errorfAt creates a new error covering the span of the line held in b.
+func errorfAt(b buf.Buffer, format string, args ...any) error {
+	return errorAt(b, fmt.Errorf(format, args...))
+}
+
+// diagnosticAt turns an error into a diagnostic at pos. If the error carries a
+// span the columns from that are used instead of the one in pos. Errors that
+// are already diagnostics are returned unchanged.
+func diagnosticAt(pos Position, err error) Diagnostic {
+	var diag Diagnostic
+	if errors.As(err, &diag) {
+		return diag
+	}
+	d := Diagnostic{Pos: pos, Severity: SeverityError, Message: err.Error(), err: err}
+	var span *spanError
+	if errors.As(err, &span) {
+		d.Pos.Col = span.col + 1
+		d.EndCol = span.endCol + 1
+	}
+	return d
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mikerowehl/asm/buf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnosticFormat(t *testing.T) {
+	diags := Diagnostics{
+		{Pos: Position{File: "a.asm", Line: 3, Col: 2}, Severity: SeverityError, Message: "bad"},
+		{Pos: Position{Line: 4, Col: 1}, Severity: SeverityWarning, Message: "odd"},
+	}
+	require.Equal(t, "a.asm:3:2: error: bad\n4:1: warning: odd", diags.Error())
+	require.Nil(t, Diagnostics{}.err())
+}
+
+func TestDiagnosticAt(t *testing.T) {
+	pos := Position{File: "a.asm", Line: 7, Col: 1}
+	cause := errors.New("cause")
+	d := diagnosticAt(pos, cause)
+	require.Equal(t, pos, d.Pos)
+	require.Equal(t, 0, d.EndCol)
+	require.ErrorIs(t, d, cause)
+
+	_, span := buf.NewBuffer(" LDA junk").TakeUntil(buf.Char('j'))
+	d = diagnosticAt(pos, errorAt(span, cause))
+	require.Equal(t, 6, d.Pos.Col)
+	require.Equal(t, 10, d.EndCol)
+	require.ErrorIs(t, d, cause)
+
+	// Diagnostics pass through unchanged
+	require.Equal(t, d, diagnosticAt(Position{Line: 1, Col: 1}, d))
+}
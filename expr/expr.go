@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/mikerowehl/asm/buf"
 	"strconv"
+	"strings"
 )
 
 type Op int
@@ -21,10 +22,17 @@ const (
 	tokenLeftParen
 	tokenRightParen
 	tokenOp
+	tokenFunction // Function name and the ( starting its arguments
+	tokenComma    // Between the arguments of a function
 )
 
+func (t TokenType) isOperand() bool {
+	return t == tokenNumber || t == tokenString || t == tokenIdentifier || t == tokenLeftParen ||
+		t == tokenFunction
+}
+
 func (t TokenType) canPrecedeUnary() bool {
-	return t == tokenOp || t == tokenLeftParen || t == tokenNil
+	return t == tokenOp || t == tokenLeftParen || t == tokenNil || t == tokenFunction || t == tokenComma
 }
 
 type Token struct {
@@ -36,8 +44,22 @@ type Token struct {
 }
 
 type Parser struct {
+	// Rename, if set, is applied to every identifier as it's parsed. The
+	// assembler uses it to give labels local to a macro expansion their own
+	// names.
+	Rename func(name string) string
+	// Lookup, if set, is checked for every identifier. Names it has a value
+	// for are parsed as that number, which is how the assembler substitutes
+	// loop counters.
+	Lookup func(name string) (int, bool)
+	// Functions can be called by name with their arguments in parentheses,
+	// like sizeof(table). These are checked before the builtin functions, so
+	// they can also replace one.
+	Functions map[string]*Function
+
 	nodeStack     nodeStack
 	opStack       opStack
+	calls         []call // Function calls with arguments being parsed
 	prevTokenType TokenType
 }
 
@@ -68,16 +90,32 @@ const (
 	opUnaryPlus
 	opLowByte
 	opHighByte
+	opNot
+	opComplement
 
 	opDivide
 	opMultiply
+	opModulo
 	opAdd
 	opSub
 	opLeftShift
 	opRightShift
+	opLessEqual
+	opGreaterEqual
+	opLess
+	opGreater
+	opEqual
+	opNotEqual
+	opLogicalAnd
+	opLogicalOr
 	opAnd
+	opXor
 	opOr
+	opQuestion
+	opColon
+	opTernary
 
+	opCall
 	opNumber
 	opString
 	opLeftParen
@@ -85,21 +123,51 @@ const (
 	opIdentifier
 )
 
-var opTable = []opEntry{
-	{6, 1, false, "-", func(a int, b int) int { return -a }},
-	{6, 1, false, "+", func(a int, b int) int { return a }},
-	{6, 1, false, "<", func(a int, b int) int { return a & 0xff }},
-	{6, 1, false, ">", func(a int, b int) int { return (a >> 8) & 0xff }},
-
-	{5, 2, true, "/", func(a int, b int) int { return a / b }},
-	{5, 2, true, "*", func(a int, b int) int { return a * b }},
-	{4, 2, true, "+", func(a int, b int) int { return a + b }},
-	{4, 2, true, "-", func(a int, b int) int { return a - b }},
-	{3, 2, true, "<<", func(a int, b int) int { return a << b }},
-	{3, 2, true, ">>", func(a int, b int) int { return a >> b }},
-	{2, 2, true, "&", func(a int, b int) int { return a & b }},
-	{1, 2, true, "|", func(a int, b int) int { return a | b }},
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
 
+// Operators are matched in table order, so any operator has to come before
+// the shorter ones that are a prefix of it. The precedence levels follow C,
+// which is what most 6502 assemblers use, from the unary operators binding
+// tightest down to ?: binding loosest. < and > are the low and high byte
+// where an operand is expected and comparisons after one.
+var opTable = []opEntry{
+	{12, 1, false, "-", func(a int, b int) int { return -a }},
+	{12, 1, false, "+", func(a int, b int) int { return a }},
+	{12, 1, false, "<", func(a int, b int) int { return a & 0xff }},
+	{12, 1, false, ">", func(a int, b int) int { return (a >> 8) & 0xff }},
+	{12, 1, false, "!", func(a int, b int) int { return boolValue(a == 0) }},
+	{12, 1, false, "~", func(a int, b int) int { return ^a }},
+
+	{11, 2, true, "/", func(a int, b int) int { return a / b }},
+	{11, 2, true, "*", func(a int, b int) int { return a * b }},
+	{11, 2, true, "%", func(a int, b int) int { return a % b }},
+	{10, 2, true, "+", func(a int, b int) int { return a + b }},
+	{10, 2, true, "-", func(a int, b int) int { return a - b }},
+	{9, 2, true, "<<", func(a int, b int) int { return a << b }},
+	{9, 2, true, ">>", func(a int, b int) int { return a >> b }},
+	{8, 2, true, "<=", func(a int, b int) int { return boolValue(a <= b) }},
+	{8, 2, true, ">=", func(a int, b int) int { return boolValue(a >= b) }},
+	{8, 2, true, "<", func(a int, b int) int { return boolValue(a < b) }},
+	{8, 2, true, ">", func(a int, b int) int { return boolValue(a > b) }},
+	{7, 2, true, "==", func(a int, b int) int { return boolValue(a == b) }},
+	{7, 2, true, "!=", func(a int, b int) int { return boolValue(a != b) }},
+	{3, 2, true, "&&", func(a int, b int) int { return boolValue(a != 0 && b != 0) }},
+	{2, 2, true, "||", func(a int, b int) int { return boolValue(a != 0 || b != 0) }},
+	{6, 2, true, "&", func(a int, b int) int { return a & b }},
+	{5, 2, true, "^", func(a int, b int) int { return a ^ b }},
+	{4, 2, true, "|", func(a int, b int) int { return a | b }},
+	// ? and : are only used while parsing, they're combined into a single
+	// ternary node once the : is found
+	{1, 2, false, "?", nil},
+	{1, 2, false, ":", nil},
+	{1, 3, false, "", nil},
+
+	{0, 0, false, "", nil}, // function call
 	{0, 0, false, "", nil}, // num
 	{0, 0, false, "", nil}, // string
 	{0, 0, false, "", nil}, // left paren
@@ -115,6 +183,10 @@ func (op Op) isUnary() bool {
 	return opTable[op].childCount == 1
 }
 
+func (op Op) isTernary() bool {
+	return opTable[op].childCount == 3
+}
+
 func (op Op) eval(a int, b int) int {
 	return opTable[op].eval(a, b)
 }
@@ -138,19 +210,31 @@ type Node struct {
 	op         Op
 	value      int
 	identifier string
+	str        string
 	evaluated  bool
 	lChild     *Node
+	mChild     *Node // Only used by ?:, which has the condition in lChild
 	rChild     *Node
+	fn         *Function // Function called, with the name in identifier
+	args       []*Node
 }
 
 func (n *Node) String() string {
 	switch {
 	case n.op == opNumber:
 		return fmt.Sprintf("%d", n.value)
+	case n.op == opString:
+		return strconv.Quote(n.str)
+	case n.op == opIdentifier:
+		return n.identifier
+	case n.op == opCall:
+		return n.callString()
 	case n.op.isBinary():
 		return fmt.Sprintf("%s %s %s", n.lChild.String(), n.rChild.String(), n.op.sym())
 	case n.op.isUnary():
 		return fmt.Sprintf("%s %s", n.lChild.String(), n.op.sym())
+	case n.op.isTernary():
+		return fmt.Sprintf("%s %s %s ?:", n.lChild.String(), n.mChild.String(), n.rChild.String())
 	default:
 		return "unknown"
 	}
@@ -164,42 +248,131 @@ func (e *UndefinedSymbolError) Error() string {
 	return fmt.Sprintf("undefined symbol: %s", e.Name)
 }
 
+// Resolver looks up the values of symbols while an expression is evaluated.
+// defined is false for symbols without a value, which makes evaluation fail
+// with an UndefinedSymbolError. Any error returned stops the evaluation.
+type Resolver interface {
+	Resolve(name string) (value int, defined bool, err error)
+}
+
+// Symbols is a Resolver for a table of symbol values.
+type Symbols map[string]int
+
+func (s Symbols) Resolve(name string) (int, bool, error) {
+	val, found := s[name]
+	return val, found, nil
+}
+
+// Eval evaluates the expression using the values in sym, caching the result
+// so later calls return the same value until Reset is called. Returns true
+// once the expression has a value.
 func (n *Node) Eval(sym map[string]int) (bool, error) {
-	var ok bool
-	var err error
 	if !n.evaluated {
-		switch {
-		case n.op == opNumber:
-			n.evaluated = true
-		case n.op == opIdentifier:
-			n.value, ok = sym[n.identifier]
-			if !ok {
-				return false, &UndefinedSymbolError{Name: n.identifier}
-			}
-			n.evaluated = true
-		case n.op.isBinary():
-			ok, err = n.lChild.Eval(sym)
-			if err != nil {
-				return false, err
-			}
-			ok, err = n.rChild.Eval(sym)
-			if err != nil {
-				return false, err
-			}
-			n.value = n.op.eval(n.lChild.value, n.rChild.value)
-			n.evaluated = true
-		case n.op.isUnary():
-			ok, err = n.lChild.Eval(sym)
-			if err != nil {
-				return false, err
-			}
-			n.value = n.op.eval(n.lChild.value, 0)
-			n.evaluated = true
+		val, err := n.Evaluate(Symbols(sym))
+		if err != nil {
+			return false, err
 		}
+		n.value = val
+		n.evaluated = true
 	}
 	return n.evaluated, nil
 }
 
+// Evaluate works out the value of the expression, looking up symbols with r.
+// Unlike Eval nothing is cached, so the same expression can be evaluated any
+// number of times against symbols that change in between.
+func (n *Node) Evaluate(r Resolver) (int, error) {
+	switch {
+	case n.op == opNumber:
+		return n.value, nil
+	case n.op == opString:
+		return 0, fmt.Errorf("string %s used as a number", strconv.Quote(n.str))
+	case n.op == opIdentifier:
+		val, found, err := r.Resolve(n.identifier)
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			return 0, &UndefinedSymbolError{Name: n.identifier}
+		}
+		return val, nil
+	case n.op == opCall:
+		return n.fn.Call(n.args, r)
+	case n.op.isBinary():
+		left, err := n.lChild.Evaluate(r)
+		if err != nil {
+			return 0, err
+		}
+		right, err := n.rChild.Evaluate(r)
+		if err != nil {
+			return 0, err
+		}
+		if (n.op == opDivide || n.op == opModulo) && right == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		if (n.op == opLeftShift || n.op == opRightShift) && right < 0 {
+			return 0, fmt.Errorf("negative shift count %d", right)
+		}
+		return n.op.eval(left, right), nil
+	case n.op.isTernary():
+		// Only the branch picked by the condition is evaluated, so the
+		// other one can use symbols that aren't defined
+		cond, err := n.lChild.Evaluate(r)
+		if err != nil {
+			return 0, err
+		}
+		if cond != 0 {
+			return n.mChild.Evaluate(r)
+		}
+		return n.rChild.Evaluate(r)
+	case n.op.isUnary():
+		val, err := n.lChild.Evaluate(r)
+		if err != nil {
+			return 0, err
+		}
+		return n.op.eval(val, 0), nil
+	}
+	return 0, fmt.Errorf("can't evaluate %s", n)
+}
+
+// StringValue returns the text of an expression that is just a string
+// literal. ok is false for any other kind of expression.
+func (n *Node) StringValue() (s string, ok bool) {
+	if n.op != opString {
+		return "", false
+	}
+	return n.str, true
+}
+
+// Identifier returns the name of the symbol in an expression that is just a
+// symbol. ok is false for any other kind of expression.
+func (n *Node) Identifier() (name string, ok bool) {
+	if n.op != opIdentifier {
+		return "", false
+	}
+	return n.identifier, true
+}
+
+// Reset clears the values cached by earlier calls to Eval, so the expression
+// can be evaluated again after the symbol table has changed.
+func (n *Node) Reset() {
+	if n.op != opNumber {
+		n.evaluated = false
+	}
+	if n.lChild != nil {
+		n.lChild.Reset()
+	}
+	if n.mChild != nil {
+		n.mChild.Reset()
+	}
+	if n.rChild != nil {
+		n.rChild.Reset()
+	}
+	for _, arg := range n.args {
+		arg.Reset()
+	}
+}
+
 func (n *Node) Value() (int, error) {
 	if !n.evaluated {
 		return 0, fmt.Errorf("Attempt to take value of unevaluated expression")
@@ -209,8 +382,11 @@ func (n *Node) Value() (int, error) {
 
 func (p *Parser) Parse(line buf.Buffer) (n *Node, remain buf.Buffer, err error) {
 	p.prevTokenType = tokenNil
+	p.nodeStack, p.opStack, p.calls = nodeStack{}, opStack{}, nil
 	for err == nil {
 		var token Token
+		prev := p.prevTokenType
+		afterOperand := !prev.canPrecedeUnary()
 		token, remain, err = p.parseToken(line)
 		if err != nil {
 			return
@@ -219,6 +395,12 @@ func (p *Parser) Parse(line buf.Buffer) (n *Node, remain buf.Buffer, err error)
 		if token.typ == tokenNil {
 			break
 		}
+		// Two operands in a row means the expression has already ended, the
+		// caller can decide what to do with the rest
+		if afterOperand && token.typ.isOperand() {
+			remain = line
+			break
+		}
 
 		switch token.typ {
 		case tokenNumber:
@@ -228,7 +410,22 @@ func (p *Parser) Parse(line buf.Buffer) (n *Node, remain buf.Buffer, err error)
 				evaluated: true,
 			}
 			p.nodeStack.push(cur)
+		case tokenString:
+			cur := &Node{
+				op:  opString,
+				str: token.stringValue,
+			}
+			p.nodeStack.push(cur)
 		case tokenIdentifier:
+			if p.Lookup != nil {
+				if val, found := p.Lookup(token.identifier); found {
+					p.nodeStack.push(&Node{op: opNumber, value: val, evaluated: true})
+					break
+				}
+			}
+			if p.Rename != nil {
+				token.identifier = p.Rename(token.identifier)
+			}
 			cur := &Node{
 				op:         opIdentifier,
 				identifier: token.identifier,
@@ -236,6 +433,13 @@ func (p *Parser) Parse(line buf.Buffer) (n *Node, remain buf.Buffer, err error)
 			}
 			p.nodeStack.push(cur)
 		case tokenOp:
+			if token.op == opColon {
+				err = p.colon()
+				if err != nil {
+					return
+				}
+				break
+			}
 			for err == nil && !p.opStack.isEmpty() && token.op.canTree(p.opStack.peek()) {
 				var treeOp Op
 				treeOp, err = p.opStack.pop()
@@ -248,6 +452,12 @@ func (p *Parser) Parse(line buf.Buffer) (n *Node, remain buf.Buffer, err error)
 				}
 			}
 			p.opStack.push(token.op)
+		case tokenFunction:
+			p.startCall(token.identifier)
+		case tokenComma:
+			if err = p.argSeparator(prev); err != nil {
+				return
+			}
 		case tokenLeftParen:
 			p.opStack.push(opLeftParen)
 		case tokenRightParen:
@@ -269,15 +479,24 @@ func (p *Parser) Parse(line buf.Buffer) (n *Node, remain buf.Buffer, err error)
 					return
 				}
 			}
+			if _, err = p.endCall(prev); err != nil {
+				return
+			}
 		}
 		line = remain
 	}
 
+	if len(p.calls) > 0 {
+		return nil, remain, fmt.Errorf("missing ) after the arguments to %s", p.calls[len(p.calls)-1].name)
+	}
 	for err == nil && !p.opStack.isEmpty() {
 		op, err := p.opStack.pop()
 		if err != nil {
 			return nil, buf.Buffer{}, err
 		}
+		if op == opLeftParen {
+			return nil, buf.Buffer{}, fmt.Errorf("missing )")
+		}
 		err = p.nodeStack.tree(op)
 		if err != nil {
 			return nil, buf.Buffer{}, err
@@ -288,22 +507,65 @@ func (p *Parser) Parse(line buf.Buffer) (n *Node, remain buf.Buffer, err error)
 	return
 }
 
+// colon handles the : of a ?: expression. Everything since the ? is the
+// value for when the condition is true, so it's finished off the same way as
+// the inside of parentheses, and the ? is replaced by the ternary operator.
+func (p *Parser) colon() error {
+	for !p.opStack.isEmpty() {
+		op, err := p.opStack.pop()
+		if err != nil {
+			return err
+		}
+		if op == opQuestion {
+			p.opStack.push(opTernary)
+			return nil
+		}
+		if op == opLeftParen {
+			break
+		}
+		if err = p.nodeStack.tree(op); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf(": without ?")
+}
+
 func (p *Parser) parseToken(line buf.Buffer) (t Token, remain buf.Buffer, err error) {
 	// If there's nothing left in the buffer or we hit an experssion end
-	// character like a comma, end the parsing
-	if line.IsEmpty() || line.StartsWith(buf.Char(',')) {
+	// character like a comma or the start of a comment, end the parsing. A
+	// comma between the arguments of a function doesn't end the expression.
+	ending := line.StartsWith(buf.Char(',')) && len(p.calls) == 0
+	if line.IsEmpty() || ending || line.StartsWith(buf.Char(';')) {
 		t.typ = tokenNil
 		remain = line
 		return
 	}
 
 	switch {
-	case line.StartsWith(buf.Digit) || line.StartsWith(buf.Char('$')):
+	case line.StartsWith(buf.Char(',')):
+		t.typ = tokenComma
+		remain = line.Advance(1)
+	case p.prevTokenType.canPrecedeUnary() && isProgramCounter(line):
+		t.identifier = ProgramCounter
+		t.typ = tokenIdentifier
+		remain = line.Advance(1)
+	case p.isNumber(line):
 		t.value, remain, err = p.parseNumber(line)
 		t.typ = tokenNumber
-	case line.StartsWith(buf.Letter):
+	case line.StartsWith(buf.Char('\'')):
+		t.value, remain, err = p.parseChar(line)
+		t.typ = tokenNumber
+	case isIdentifier(line):
 		t.identifier, remain, err = p.parseIdentifier(line)
 		t.typ = tokenIdentifier
+		if err == nil && remain.StartsWith(buf.Char('(')) {
+			t, remain, err = p.parseCall(t.identifier, remain)
+		}
+	case p.prevTokenType.canPrecedeUnary() && anonymousLabel(line) > 0:
+		n := anonymousLabel(line)
+		t.identifier = line.Trunc(n).String()
+		t.typ = tokenIdentifier
+		remain = line.Advance(n)
 	case line.StartsWith(buf.Char('"')):
 		t.stringValue, remain, err = p.parseString(line)
 		t.typ = tokenString
@@ -318,7 +580,9 @@ func (p *Parser) parseToken(line buf.Buffer) (t Token, remain buf.Buffer, err er
 	default:
 		for i, o := range opTable {
 			if o.parseable() && line.StartsWith(buf.Str(o.sym)) {
-				if o.isBinary() || (o.isUnary() && p.prevTokenType.canPrecedeUnary()) {
+				// Binary operators can only follow an operand, and unary
+				// ones only appear where an operand is expected
+				if o.isBinary() != p.prevTokenType.canPrecedeUnary() {
 					t.typ = tokenOp
 					t.op = Op(i)
 					remain = line.Advance(len(o.sym))
@@ -337,32 +601,81 @@ func (p *Parser) parseToken(line buf.Buffer) (t Token, remain buf.Buffer, err er
 	return
 }
 
+// binaryDigit is a Compare function for the digits 0 and 1.
+func binaryDigit(s string) bool {
+	return s[0] == '0' || s[0] == '1'
+}
+
+// octalDigit is a Compare function for the digits 0-7.
+func octalDigit(s string) bool {
+	return s[0] >= '0' && s[0] <= '7'
+}
+
+// isNumber checks for the start of a number. % is only a binary number where
+// an operand is expected, after an operand it's the modulo operator. @ is
+// only octal when a digit follows, otherwise it starts a local label.
+func (p *Parser) isNumber(line buf.Buffer) bool {
+	switch {
+	case line.StartsWith(buf.Digit) || line.StartsWith(buf.Char('$')):
+		return true
+	case line.StartsWith(buf.Char('%')):
+		return p.prevTokenType.canPrecedeUnary() && line.Advance(1).StartsWith(binaryDigit)
+	case line.StartsWith(buf.Char('@')):
+		return line.Advance(1).StartsWith(buf.Digit)
+	}
+	return false
+}
+
+// identifyNumber works out the base of a number from its prefix, returning
+// the digits after the prefix along with the base and the Compare function
+// for digits in that base:
+//
+//	$ff 0xff      hex
+//	%1010 0b1010  binary
+//	@17 0o17      octal
+//	123           decimal
 func (p *Parser) identifyNumber(line buf.Buffer) (remain buf.Buffer, base int,
 	digitFn buf.Compare) {
-	remain = line
-	if remain.StartsWith(buf.Char('$')) {
-		remain = remain.Advance(1)
-		base = 16
-		digitFn = buf.HexDigit
-		return
-	} else if remain.StartsWith(buf.Str("0x")) {
-		remain = remain.Advance(2)
-		base = 16
-		digitFn = buf.HexDigit
-		return
+	prefixes := []struct {
+		prefix  string
+		base    int
+		digitFn buf.Compare
+	}{
+		{"$", 16, buf.HexDigit},
+		{"0x", 16, buf.HexDigit},
+		{"%", 2, binaryDigit},
+		{"0b", 2, binaryDigit},
+		{"@", 8, octalDigit},
+		{"0o", 8, octalDigit},
 	}
-	base = 10
-	digitFn = buf.Digit
-	return
+	for _, pr := range prefixes {
+		if line.StartsWith(buf.Str(pr.prefix)) {
+			return line.Advance(len(pr.prefix)), pr.base, pr.digitFn
+		}
+	}
+	return line, 10, buf.Digit
 }
 
+// parseNumber parses a number in any of the bases from identifyNumber. The
+// digits can be split up with _ to make long numbers easier to read, like
+// %0101_1010 or 1_000_000.
 func (p *Parser) parseNumber(line buf.Buffer) (value int, remain buf.Buffer,
 	err error) {
-	line, base, digitFn := p.identifyNumber(line)
-
-	str, remain := line.TakeWhile(digitFn)
-	num, err := strconv.ParseInt(str.String(), base, 32)
+	digits, base, digitFn := p.identifyNumber(line)
+
+	str, remain := digits.TakeWhile(func(s string) bool {
+		return digitFn(s) || s[0] == '_'
+	})
+	text := str.String()
+	number := line.Trunc(len(line.String()) - len(remain.String()))
+	if text == "" || text[0] == '_' || text[len(text)-1] == '_' {
+		err = fmt.Errorf("bad number %s", number)
+		return
+	}
+	// Numbers are unsigned, up to 32 bits so any .DWORD value can be written
+	num, err := strconv.ParseUint(strings.ReplaceAll(text, "_", ""), base, 32)
 	if err != nil {
+		err = fmt.Errorf("bad number %s, larger than 32 bits", number)
 		return
 	}
 
@@ -370,6 +683,19 @@ func (p *Parser) parseNumber(line buf.Buffer) (value int, remain buf.Buffer,
 	return
 }
 
+// parseChar parses a character literal like 'A', which has the value of the
+// character. The value is the same byte the character has in a string, so
+// 'A' matches the first byte of .TEXT "A".
+func (p *Parser) parseChar(line buf.Buffer) (value int, remain buf.Buffer,
+	err error) {
+	s := line.String()
+	if len(s) < 3 || s[2] != '\'' || s[1] == '\'' {
+		err = fmt.Errorf("bad character literal in: %s", line)
+		return
+	}
+	return int(s[1]), line.Advance(3), nil
+}
+
 func (p *Parser) parseString(line buf.Buffer) (value string, remain buf.Buffer,
 	err error) {
 	remain = line.Advance(1)
@@ -383,9 +709,52 @@ func (p *Parser) parseString(line buf.Buffer) (value string, remain buf.Buffer,
 	return
 }
 
+// ProgramCounter is the identifier * and $ are parsed as where an operand is
+// expected. The value has to be bound to the address of the code being
+// assembled when the expression is evaluated.
+const ProgramCounter = "*"
+
+// isProgramCounter checks for * or a $ that isn't the start of a hex number,
+// which refer to the program counter when they're used as an operand.
+func isProgramCounter(line buf.Buffer) bool {
+	if line.StartsWith(buf.Char('$')) {
+		return !line.Advance(1).StartsWith(buf.HexDigit)
+	}
+	return line.StartsWith(buf.Char('*'))
+}
+
+// isIdentifier checks for the start of an identifier, which can have a @ or .
+// in front to make it a local label.
+func isIdentifier(line buf.Buffer) bool {
+	if line.StartsWith(buf.Char('@')) || line.StartsWith(buf.Char('.')) {
+		line = line.Advance(1)
+	}
+	return line.StartsWith(buf.IdentifierStart)
+}
+
+// anonymousLabel checks for a reference to an anonymous label, a run of +
+// or - signs on their own where an operand is expected, like bne -- or
+// jmp +. Returns the length of the run, or 0 if it's not a reference.
+func anonymousLabel(line buf.Buffer) int {
+	if !line.StartsWith(buf.Char('+')) && !line.StartsWith(buf.Char('-')) {
+		return 0
+	}
+	n := line.Scan(buf.Char(line.String()[0]))
+	after := line.Advance(n)
+	after = after.Advance(after.Scan(buf.Whitespace))
+	if after.IsEmpty() || after.StartsWith(buf.Char(',')) || after.StartsWith(buf.Char(';')) || after.StartsWith(buf.Char(')')) {
+		return n
+	}
+	return 0
+}
+
 func (p *Parser) parseIdentifier(line buf.Buffer) (value string, remain buf.Buffer,
 	err error) {
-	valueBuf, remain := line.TakeWhile(buf.Letter)
-	value = valueBuf.String()
+	prefix := 0
+	if line.StartsWith(buf.Char('@')) || line.StartsWith(buf.Char('.')) {
+		prefix = 1
+	}
+	_, remain = line.Advance(prefix).TakeWhile(buf.IdentifierChar)
+	value = line.Trunc(len(line.String()) - len(remain.String())).String()
 	return
 }
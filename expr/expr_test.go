@@ -30,6 +30,20 @@ func TestParseNumber(t *testing.T) {
 			expectedRemain: "w",
 			expectedErr:    true,
 		},
+		{input: "%01010101", expectedVal: 0x55},
+		{input: "0b1010,1", expectedVal: 10, expectedRemain: ",1"},
+		{input: "%0101_1010", expectedVal: 0x5a},
+		{input: "@17", expectedVal: 15},
+		{input: "0o777", expectedVal: 511},
+		{input: "1_000_000", expectedVal: 1000000},
+		{input: "$c0_00", expectedVal: 0xc000},
+		{input: "%2", expectedRemain: "2", expectedErr: true},
+		{input: "@8", expectedRemain: "8", expectedErr: true},
+		{input: "1_", expectedVal: 0, expectedErr: true},
+		{input: "$_ff", expectedVal: 0, expectedErr: true},
+		{input: "$FFFFFFFF", expectedVal: 0xffffffff},
+		{input: "4294967295", expectedVal: 4294967295},
+		{input: "$100000000", expectedRemain: "", expectedErr: true},
 	}
 	for _, tc := range tests {
 		p := Parser{}
@@ -53,6 +67,21 @@ func TestParseIdentifier(t *testing.T) {
 			expectedVal:    "abcd",
 			expectedRemain: "",
 			expectedErr:    false,
+		}, {
+			input:          "loop_2+1",
+			expectedVal:    "loop_2",
+			expectedRemain: "+1",
+			expectedErr:    false,
+		}, {
+			input:          "@skip,X",
+			expectedVal:    "@skip",
+			expectedRemain: ",X",
+			expectedErr:    false,
+		}, {
+			input:          ".next",
+			expectedVal:    ".next",
+			expectedRemain: "",
+			expectedErr:    false,
 		},
 	}
 	for _, tc := range tests {
@@ -258,3 +287,399 @@ func TestEvalError(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, 5, n.value)
 }
+
+// TestEvalReset makes sure a reset expression picks up the new value of a
+// symbol that changed after the first evaluation.
+func TestEvalReset(t *testing.T) {
+	bindings := map[string]int{
+		"label": 10,
+	}
+	p := Parser{}
+	n, _, e := p.Parse(buf.NewBuffer("label+1"))
+	require.Nil(t, e)
+	_, err := n.Eval(bindings)
+	require.Nil(t, err)
+	require.Equal(t, 11, n.value)
+	bindings["label"] = 20
+	_, err = n.Eval(bindings)
+	require.Nil(t, err)
+	require.Equal(t, 11, n.value)
+	n.Reset()
+	_, err = n.Eval(bindings)
+	require.Nil(t, err)
+	require.Equal(t, 21, n.value)
+}
+
+func TestParseString(t *testing.T) {
+	p := Parser{}
+	n, r, e := p.Parse(buf.NewBuffer(`"HELLO, WORLD",1`))
+	require.Nil(t, e)
+	require.Equal(t, ",1", r.String())
+	s, ok := n.StringValue()
+	require.True(t, ok)
+	require.Equal(t, "HELLO, WORLD", s)
+	_, err := n.Eval(map[string]int{})
+	require.NotNil(t, err)
+
+	n, _, e = p.Parse(buf.NewBuffer("1+2"))
+	require.Nil(t, e)
+	_, ok = n.StringValue()
+	require.False(t, ok)
+}
+
+func TestParseRename(t *testing.T) {
+	p := Parser{Rename: func(name string) string {
+		if name == "loop" {
+			return "loop@1"
+		}
+		return name
+	}}
+	n, _, e := p.Parse(buf.NewBuffer("loop+other"))
+	require.Nil(t, e)
+	_, err := n.Eval(map[string]int{"loop@1": 2, "other": 3})
+	require.Nil(t, err)
+	require.Equal(t, 5, n.value)
+}
+
+func TestEvalComparison(t *testing.T) {
+	bindings := map[string]int{
+		"PAL":   1,
+		"DEBUG": 0,
+	}
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"PAL == 1", 1},
+		{"PAL != 1", 0},
+		{"2 < 3", 1},
+		{"3 <= 3", 1},
+		{"2 > 3", 0},
+		{"4 >= 3", 1},
+		{"1 << 2 < 5", 1},
+		{"($1234 & $ff) == $34", 1},
+		{"$1234 & $ff == $34", 0},
+		{"PAL && DEBUG", 0},
+		{"PAL || DEBUG", 1},
+		{"PAL == 1 && DEBUG == 0", 1},
+		{"!DEBUG", 1},
+		{"!PAL || !DEBUG && PAL", 1},
+		{"<$1234 > >$1234", 1},
+		{"- 3 < -2", 1},
+	}
+	for _, tc := range tests {
+		p := Parser{}
+		n, remain, e := p.Parse(buf.NewBuffer(tc.input))
+		require.Nil(t, e, tc.input)
+		require.True(t, remain.IsEmpty(), tc.input)
+		_, err := n.Eval(bindings)
+		require.Nil(t, err, tc.input)
+		require.Equal(t, tc.expected, n.value, tc.input)
+	}
+}
+
+func TestEvalOperators(t *testing.T) {
+	bindings := map[string]int{
+		"label": 0x1234,
+		"zero":  0,
+	}
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"17 % 5", 2},
+		{"2 + 17 % 5 * 2", 6},
+		{"$ff ^ $0f", 0xf0},
+		{"~0", -1},
+		{"~$0f & $ff", 0xf0},
+		{"1 | 2 ^ 3 & 6", 1 | (2 ^ (3 & 6))},
+		{"1 + 2 == 3", 1},
+		{"1 < 2 == 2 > 1", 1},
+		{"1 == 1 && 2", 1},
+		{"0 || 1 && 0", 0},
+		{"1 ? 2 : 3", 2},
+		{"0 ? 2 : 3", 3},
+		{"zero ? 2 : 1 + 2", 3},
+		{"0 ? 1 : 0 ? 2 : 3", 3},
+		{"1 ? 0 ? 4 : 5 : 6", 5},
+		{"(1 ? 2 : 3) + 4", 6},
+		{"zero ? undefined : 7", 7},
+		// < and > are the low and high byte where an operand is expected
+		// and comparisons after one
+		{"<label", 0x34},
+		{">label", 0x12},
+		{"label < 2", 0},
+		{"label<<2", 0x48d0},
+		{"label > <label", 1},
+		{">label < <label", 1},
+		{"<label>>4", 3},
+		{"-<label", -0x34},
+	}
+	for _, tc := range tests {
+		p := Parser{}
+		n, remain, e := p.Parse(buf.NewBuffer(tc.input))
+		require.Nil(t, e, tc.input)
+		require.True(t, remain.IsEmpty(), tc.input)
+		_, err := n.Eval(bindings)
+		require.Nil(t, err, tc.input)
+		require.Equal(t, tc.expected, n.value, tc.input)
+	}
+}
+
+func TestEvalOperatorErrors(t *testing.T) {
+	parseErrors := []string{
+		"1 ? 2",
+		"1 : 2",
+		"(1 ? 2) : 3",
+		"1 ? 2 : ",
+	}
+	for _, input := range parseErrors {
+		p := Parser{}
+		_, _, e := p.Parse(buf.NewBuffer(input))
+		require.NotNil(t, e, input)
+	}
+	for _, input := range []string{"1 / 0", "1 % (2 - 2)"} {
+		p := Parser{}
+		n, _, e := p.Parse(buf.NewBuffer(input))
+		require.Nil(t, e, input)
+		_, err := n.Eval(map[string]int{})
+		require.ErrorContains(t, err, "division by zero", input)
+	}
+	for _, input := range []string{"1 << -1", "8 >> (1 - 2)"} {
+		p := Parser{}
+		n, _, e := p.Parse(buf.NewBuffer(input))
+		require.Nil(t, e, input)
+		_, err := n.Eval(map[string]int{})
+		require.ErrorContains(t, err, "negative shift count", input)
+	}
+}
+
+func TestEvalLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"'A'", 65},
+		{"'a' - 'A'", 32},
+		{"';'", 59},
+		{"','", 44},
+		{"%1111 % 4", 3},
+		{"7%%11", 1},
+		{"-%10", -2},
+		{"(%10)", 2},
+		{"@10 + 0o10", 16},
+		{"0b1_0 << 2", 8},
+	}
+	for _, tc := range tests {
+		p := Parser{}
+		n, remain, e := p.Parse(buf.NewBuffer(tc.input))
+		require.Nil(t, e, tc.input)
+		require.True(t, remain.IsEmpty(), tc.input)
+		_, err := n.Eval(map[string]int{})
+		require.Nil(t, err, tc.input)
+		require.Equal(t, tc.expected, n.value, tc.input)
+	}
+	for _, input := range []string{"'A", "''", "'AB'"} {
+		p := Parser{}
+		_, _, e := p.Parse(buf.NewBuffer(input))
+		require.NotNil(t, e, input)
+	}
+}
+
+func TestEvalProgramCounter(t *testing.T) {
+	bindings := map[string]int{
+		ProgramCounter: 0x1000,
+		"start":        0x0ff0,
+	}
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"*", 0x1000},
+		{"$", 0x1000},
+		{"*-2", 0x0ffe},
+		{"* - start", 0x10},
+		{"$ - start", 0x10},
+		{"*+$10", 0x1010},
+		{"*/2", 0x800},
+		{"2**", 0x2000},
+		{"* * *", 0x1000000},
+		{"(*&$ff)", 0},
+		{"<*", 0},
+		{">$", 0x10},
+		{"$ff*2", 0x1fe},
+	}
+	for _, tc := range tests {
+		p := Parser{}
+		n, remain, e := p.Parse(buf.NewBuffer(tc.input))
+		require.Nil(t, e, tc.input)
+		require.True(t, remain.IsEmpty(), tc.input)
+		_, err := n.Eval(bindings)
+		require.Nil(t, err, tc.input)
+		require.Equal(t, tc.expected, n.value, tc.input)
+	}
+}
+
+func TestEvalFunctions(t *testing.T) {
+	bindings := map[string]int{
+		"addr": 0x12345,
+		"neg":  -5,
+		"lo":   7,
+	}
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"lo(addr)", 0x45},
+		{"hi(addr)", 0x23},
+		{"bank(addr)", 0x01},
+		{"abs(neg)", 5},
+		{"abs(3)", 3},
+		{"min(3, 1, 2)", 1},
+		{"max(3, neg)", 3},
+		{"min(4)", 4},
+		{`strlen("HELLO")`, 5},
+		{"defined(addr)", 1},
+		{"defined(missing)", 0},
+		{"max(1, min(5, 3)) * 2", 6},
+		{"min((1 + 2) * 2, 7)", 6},
+		{"max(neg ? 1 : 2, 0)", 1},
+		{"-lo(addr)", -0x45},
+		{"lo + 1", 8},
+	}
+	for _, tc := range tests {
+		p := Parser{}
+		n, remain, e := p.Parse(buf.NewBuffer(tc.input))
+		require.Nil(t, e, tc.input)
+		require.True(t, remain.IsEmpty(), tc.input)
+		_, err := n.Eval(bindings)
+		require.Nil(t, err, tc.input)
+		require.Equal(t, tc.expected, n.value, tc.input)
+	}
+
+	p := Parser{}
+	n, remain, e := p.Parse(buf.NewBuffer("min(1, 2), 3"))
+	require.Nil(t, e)
+	require.Equal(t, ", 3", remain.String())
+	require.Equal(t, "1 2 min()", n.String())
+}
+
+func TestParseFunctionErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"foo(1)", "unknown function foo"},
+		{"lo()", "lo needs at least 1 argument"},
+		{"lo(1, 2)", "lo takes at most 1 argument"},
+		{"min(1,)", "missing argument to min"},
+		{"min(,1)", "missing argument to min"},
+		{"min(1, 2", "missing ) after the arguments to min"},
+		{"min((1, 2))", "unexpected , inside parentheses"},
+		{"(1", "missing )"},
+		{"2 * ((1 + 2)", "missing )"},
+		{"1 +", "missing operand for +"},
+		{"(1 *)", "missing operand for *"},
+		{"~", "missing operand for ~"},
+		{"1 ? 2 :", "missing operand for ?:"},
+		{"()", "empty expression"},
+		{"", "empty expression"},
+	}
+	for _, tc := range tests {
+		p := Parser{}
+		_, _, e := p.Parse(buf.NewBuffer(tc.input))
+		require.ErrorContains(t, e, tc.err, tc.input)
+	}
+	p := Parser{}
+	for _, input := range []string{"strlen(1)", "defined(1)", "lo(missing)"} {
+		n, _, e := p.Parse(buf.NewBuffer(input))
+		require.Nil(t, e, input)
+		_, err := n.Eval(map[string]int{})
+		require.NotNil(t, err, input)
+	}
+}
+
+func TestParserFunctions(t *testing.T) {
+	calls := 0
+	p := Parser{Functions: map[string]*Function{
+		"double": {MinArgs: 1, MaxArgs: 1, Call: func(args []*Node, r Resolver) (int, error) {
+			calls++
+			v, err := args[0].Evaluate(r)
+			return v * 2, err
+		}},
+		// Replaces the builtin
+		"lo": {MinArgs: 0, MaxArgs: 0, Call: func(args []*Node, r Resolver) (int, error) {
+			return 42, nil
+		}},
+	}}
+	n, _, e := p.Parse(buf.NewBuffer("double(x + 1) + lo()"))
+	require.Nil(t, e)
+	_, err := n.Eval(map[string]int{"x": 3})
+	require.Nil(t, err)
+	require.Equal(t, 50, n.value)
+	require.Equal(t, 1, calls)
+}
+
+// TestParserFunctionsAtParse makes sure an AtParse function is called once,
+// while parsing, and its value used from then on.
+func TestParserFunctionsAtParse(t *testing.T) {
+	seen := map[string]bool{}
+	p := Parser{Functions: map[string]*Function{
+		"seen": {MinArgs: 1, MaxArgs: 1, AtParse: true, Call: func(args []*Node, r Resolver) (int, error) {
+			require.Nil(t, r)
+			name, _ := args[0].Identifier()
+			return boolValue(seen[name]), nil
+		}},
+	}}
+	n, _, e := p.Parse(buf.NewBuffer("seen(x) * 2 + 1"))
+	require.Nil(t, e)
+	seen["x"] = true
+	val, err := n.Evaluate(Symbols{})
+	require.Nil(t, err)
+	require.Equal(t, 1, val)
+	require.Equal(t, "0 2 * 1 +", n.String())
+}
+
+// TestParseEndsAtOperand makes sure an operand following another one ends
+// the expression instead of being silently dropped.
+func TestParseEndsAtOperand(t *testing.T) {
+	p := Parser{}
+	n, remain, e := p.Parse(buf.NewBuffer(`1+2 3`))
+	require.Nil(t, e)
+	require.Equal(t, "3", remain.String())
+	_, err := n.Eval(map[string]int{})
+	require.Nil(t, err)
+	require.Equal(t, 3, n.value)
+}
+
+func TestParseLookup(t *testing.T) {
+	p := Parser{Lookup: func(name string) (int, bool) {
+		return 4, name == "i"
+	}}
+	n, _, e := p.Parse(buf.NewBuffer("base+i*2"))
+	require.Nil(t, e)
+	_, err := n.Eval(map[string]int{"base": 100})
+	require.Nil(t, err)
+	require.Equal(t, 108, n.value)
+}
+
+func TestParseAnonymousLabel(t *testing.T) {
+	tests := []struct {
+		input      string
+		identifier string
+		remain     string
+	}{
+		{"-", "-", ""},
+		{"++ ; forward", "++", "; forward"},
+		{"--,X", "--", ",X"},
+		{"-1", "", ""},
+		{"+ 2", "", ""},
+	}
+	for _, tc := range tests {
+		p := Parser{}
+		n, r, e := p.Parse(buf.NewBuffer(tc.input))
+		require.Nil(t, e, tc.input)
+		require.Equal(t, tc.identifier, n.identifier, tc.input)
+		require.Equal(t, tc.remain, r.String(), tc.input)
+	}
+}
@@ -0,0 +1,195 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mikerowehl/asm/buf"
+)
+
+// Function is a function that can be called from an expression, like
+// min(a, b). Call gets the argument expressions without evaluating them, so
+// a function like defined can look at the name of a symbol instead of its
+// value. Functions that want values can use Evaluate on the arguments.
+type Function struct {
+	MinArgs int
+	MaxArgs int // -1 for any number
+	Call    func(args []*Node, r Resolver) (int, error)
+	// AtParse functions are called with a nil Resolver as soon as the call
+	// has been parsed, and the call is replaced by the number they return.
+	// It's for functions whose answer depends on what's been parsed so far.
+	AtParse bool
+}
+
+// call is a function call whose arguments are being parsed.
+type call struct {
+	name  string
+	fn    *Function
+	paren int // Index of the call's left paren on the op stack
+	nodes int // Size of the node stack before the first argument
+}
+
+// builtins are the functions every parser has. Parser.Functions can add more
+// or replace these.
+var builtins = map[string]*Function{
+	"lo":   valueFunction(1, 1, func(v []int) int { return v[0] & 0xff }),
+	"hi":   valueFunction(1, 1, func(v []int) int { return (v[0] >> 8) & 0xff }),
+	"bank": valueFunction(1, 1, func(v []int) int { return (v[0] >> 16) & 0xff }),
+	"abs": valueFunction(1, 1, func(v []int) int {
+		if v[0] < 0 {
+			return -v[0]
+		}
+		return v[0]
+	}),
+	"min": valueFunction(1, -1, func(v []int) int {
+		m := v[0]
+		for _, x := range v[1:] {
+			m = min(m, x)
+		}
+		return m
+	}),
+	"max": valueFunction(1, -1, func(v []int) int {
+		m := v[0]
+		for _, x := range v[1:] {
+			m = max(m, x)
+		}
+		return m
+	}),
+	"strlen": {MinArgs: 1, MaxArgs: 1, Call: func(args []*Node, r Resolver) (int, error) {
+		s, ok := args[0].StringValue()
+		if !ok {
+			return 0, fmt.Errorf("strlen needs a string")
+		}
+		return len(s), nil
+	}},
+	"defined": {MinArgs: 1, MaxArgs: 1, Call: func(args []*Node, r Resolver) (int, error) {
+		name, ok := args[0].Identifier()
+		if !ok {
+			return 0, fmt.Errorf("defined needs a symbol name")
+		}
+		_, found, err := r.Resolve(name)
+		return boolValue(found), err
+	}},
+}
+
+// valueFunction makes a Function out of one that works on the values of its
+// arguments.
+func valueFunction(minArgs int, maxArgs int, fn func(values []int) int) *Function {
+	return &Function{MinArgs: minArgs, MaxArgs: maxArgs, Call: func(args []*Node, r Resolver) (int, error) {
+		values := make([]int, len(args))
+		for i, arg := range args {
+			val, err := arg.Evaluate(r)
+			if err != nil {
+				return 0, err
+			}
+			values[i] = val
+		}
+		return fn(values), nil
+	}}
+}
+
+// function looks up a function by name, in the parser's own functions first
+// and then the builtins.
+func (p *Parser) function(name string) *Function {
+	if fn, found := p.Functions[name]; found {
+		return fn
+	}
+	return builtins[name]
+}
+
+// parseCall handles an identifier followed by a (, which has to be the name
+// of a function.
+func (p *Parser) parseCall(name string, line buf.Buffer) (t Token, remain buf.Buffer, err error) {
+	if p.function(name) == nil {
+		err = fmt.Errorf("unknown function %s", name)
+		return
+	}
+	t.typ = tokenFunction
+	t.identifier = name
+	return t, line.Advance(1), nil
+}
+
+// startCall begins the arguments of a function call, which are parsed the
+// same way as the inside of parentheses.
+func (p *Parser) startCall(name string) {
+	p.opStack.push(opLeftParen)
+	p.calls = append(p.calls, call{
+		name:  name,
+		fn:    p.function(name),
+		paren: len(p.opStack.data) - 1,
+		nodes: len(p.nodeStack.data),
+	})
+}
+
+// argSeparator finishes off an argument at the , after it.
+func (p *Parser) argSeparator(prev TokenType) error {
+	c := p.calls[len(p.calls)-1]
+	if prev.canPrecedeUnary() {
+		return fmt.Errorf("missing argument to %s", c.name)
+	}
+	for len(p.opStack.data)-1 > c.paren {
+		op, err := p.opStack.pop()
+		if err != nil {
+			return err
+		}
+		if op == opLeftParen {
+			return fmt.Errorf("unexpected , inside parentheses")
+		}
+		if err = p.nodeStack.tree(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endCall replaces the arguments on the node stack with the call once its
+// closing ) has been found. Returns false if the ) wasn't the end of a call.
+func (p *Parser) endCall(prev TokenType) (bool, error) {
+	if len(p.calls) == 0 {
+		return false, nil
+	}
+	c := p.calls[len(p.calls)-1]
+	if len(p.opStack.data) != c.paren {
+		return false, nil
+	}
+	p.calls = p.calls[:len(p.calls)-1]
+	if prev == tokenComma {
+		return true, fmt.Errorf("missing argument to %s", c.name)
+	}
+	args := append([]*Node{}, p.nodeStack.data[c.nodes:]...)
+	p.nodeStack.data = p.nodeStack.data[:c.nodes]
+	switch {
+	case len(args) < c.fn.MinArgs:
+		return true, fmt.Errorf("%s needs at least %d argument%s", c.name, c.fn.MinArgs, plural(c.fn.MinArgs))
+	case c.fn.MaxArgs >= 0 && len(args) > c.fn.MaxArgs:
+		return true, fmt.Errorf("%s takes at most %d argument%s", c.name, c.fn.MaxArgs, plural(c.fn.MaxArgs))
+	}
+	if c.fn.AtParse {
+		val, err := c.fn.Call(args, nil)
+		if err != nil {
+			return true, err
+		}
+		p.nodeStack.push(&Node{op: opNumber, value: val, evaluated: true})
+		return true, nil
+	}
+	p.nodeStack.push(&Node{op: opCall, identifier: c.name, fn: c.fn, args: args})
+	return true, nil
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
+
+// callString is the postfix form of a call, the arguments followed by the
+// name of the function.
+func (n *Node) callString() string {
+	parts := []string{}
+	for _, arg := range n.args {
+		parts = append(parts, arg.String())
+	}
+	parts = append(parts, n.identifier+"()")
+	return strings.Join(parts, " ")
+}
@@ -17,7 +17,7 @@ func (s *nodeStack) push(n *Node) {
 func (s *nodeStack) pop() (n *Node, err error) {
 	l := len(s.data)
 	if l == 0 {
-		err = fmt.Errorf("Attempt to pop from empty stack: %v", s)
+		err = fmt.Errorf("empty expression")
 		return
 	}
 	n = s.data[l-1]
@@ -36,11 +36,14 @@ func (s *nodeStack) peek() (n *Node) {
 func (s *nodeStack) tree(op Op) (err error) {
 	switch {
 	case !op.isTreeable():
-		err = fmt.Errorf("Can't tree operator %v", op)
+		err = fmt.Errorf("internal error: %s isn't an operator", op.sym())
+		return
+	case op == opQuestion:
+		err = fmt.Errorf("? without :")
 		return
 	case op.isBinary():
 		if len(s.data) < 2 {
-			err = fmt.Errorf("Attempt to tree with too few nodes: %v", s)
+			err = fmt.Errorf("missing operand for %s", op.sym())
 			return
 		}
 		var rc, lc *Node
@@ -59,9 +62,21 @@ func (s *nodeStack) tree(op Op) (err error) {
 		}
 		s.push(n)
 		return
+	case op.isTernary():
+		if len(s.data) < 3 {
+			err = fmt.Errorf("missing operand for ?:")
+			return
+		}
+		n := &Node{op: op}
+		n.rChild, _ = s.pop()
+		n.mChild, _ = s.pop()
+		n.lChild, _ = s.pop()
+		s.push(n)
+		return
 	case op.isUnary():
 		if len(s.data) < 1 {
-			err = fmt.Errorf("Attempt to tree with zero nodes: %v", s)
+			err = fmt.Errorf("missing operand for %s", op.sym())
+			return
 		}
 		var lc *Node
 		lc, err = s.pop()
@@ -75,7 +90,7 @@ func (s *nodeStack) tree(op Op) (err error) {
 		s.push(n)
 		return
 	}
-	err = fmt.Errorf("Error trying to create tree for op %v", op)
+	err = fmt.Errorf("internal error: no tree for operator %s", op.sym())
 	return
 }
 
@@ -94,7 +109,7 @@ func (s *opStack) push(op Op) {
 func (s *opStack) pop() (op Op, err error) {
 	l := len(s.data)
 	if l == 0 {
-		err = fmt.Errorf("Attempt to pop from empty op stack: %v", s)
+		err = fmt.Errorf("internal error: no operator to pop")
 		return
 	}
 	op = s.data[l-1]
@@ -0,0 +1,124 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Children returns the operands of an operator or the arguments of a
+// function call, in the order they appear in the expression. Numbers, strings
+// and identifiers have none.
+func (n *Node) Children() []*Node {
+	if n.op == opCall {
+		return n.args
+	}
+	children := []*Node{}
+	for _, c := range []*Node{n.lChild, n.mChild, n.rChild} {
+		if c != nil {
+			children = append(children, c)
+		}
+	}
+	return children
+}
+
+// Operator returns the symbol for an operator node, like + or ?:, or the name
+// of the function for a call. It's empty for numbers, strings and
+// identifiers.
+func (n *Node) Operator() string {
+	switch {
+	case n.op == opCall:
+		return n.identifier
+	case n.op.isTernary():
+		return "?:"
+	}
+	return n.op.sym()
+}
+
+// Number returns the value of an expression that is just a number. ok is
+// false for any other kind of expression.
+func (n *Node) Number() (value int, ok bool) {
+	if n.op != opNumber {
+		return 0, false
+	}
+	return n.value, true
+}
+
+// Walk calls fn for n and then every node below it, depth first in the order
+// they appear in the expression. The children of a node are skipped if fn
+// returns false for it.
+func (n *Node) Walk(fn func(n *Node) bool) {
+	if !fn(n) {
+		return
+	}
+	for _, c := range n.Children() {
+		c.Walk(fn)
+	}
+}
+
+// Identifiers returns the names of the symbols used in the expression, each
+// one once in the order they first appear.
+func (n *Node) Identifiers() []string {
+	names := []string{}
+	seen := map[string]bool{}
+	n.Walk(func(c *Node) bool {
+		if name, ok := c.Identifier(); ok && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		return true
+	})
+	return names
+}
+
+// maxPrecedence is higher than any operator, for nodes that never need
+// parentheses around them.
+const maxPrecedence = 100
+
+func (n *Node) precedence() int {
+	if n.op.isTreeable() {
+		return opTable[n.op].precedence
+	}
+	return maxPrecedence
+}
+
+// Infix returns the expression written out the usual way, with parentheses
+// only where they're needed to keep the same meaning. Parsing the result
+// gives an equivalent expression, though numbers are always in decimal.
+func (n *Node) Infix() string {
+	switch {
+	case n.op == opNumber:
+		return fmt.Sprintf("%d", n.value)
+	case n.op == opString:
+		return `"` + n.str + `"`
+	case n.op == opIdentifier:
+		return n.identifier
+	case n.op == opCall:
+		args := []string{}
+		for _, arg := range n.args {
+			args = append(args, arg.Infix())
+		}
+		return fmt.Sprintf("%s(%s)", n.identifier, strings.Join(args, ", "))
+	case n.op.isUnary():
+		return n.op.sym() + n.lChild.operand(n.precedence())
+	case n.op.isTernary():
+		// ?: groups to the right, so only a ?: as the condition needs
+		// parentheses
+		return fmt.Sprintf("%s ? %s : %s", n.lChild.operand(n.precedence()+1), n.mChild.Infix(),
+			n.rChild.operand(n.precedence()))
+	case n.op.isBinary():
+		// The binary operators all group to the left, so an operator on the
+		// right with the same precedence needs parentheses
+		return fmt.Sprintf("%s %s %s", n.lChild.operand(n.precedence()), n.op.sym(),
+			n.rChild.operand(n.precedence()+1))
+	}
+	return "unknown"
+}
+
+// operand returns the infix form of n as an operand of an operator with the
+// given precedence, in parentheses if it binds less tightly.
+func (n *Node) operand(precedence int) string {
+	if n.precedence() < precedence {
+		return "(" + n.Infix() + ")"
+	}
+	return n.Infix()
+}
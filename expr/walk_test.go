@@ -0,0 +1,132 @@
+package expr
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mikerowehl/asm/buf"
+	"github.com/stretchr/testify/require"
+)
+
+// resolverFunc adapts a function to the Resolver interface.
+type resolverFunc func(name string) (int, bool, error)
+
+func (f resolverFunc) Resolve(name string) (int, bool, error) {
+	return f(name)
+}
+
+func TestEvaluate(t *testing.T) {
+	p := Parser{}
+	n, _, e := p.Parse(buf.NewBuffer("label+1"))
+	require.Nil(t, e)
+	val, err := n.Evaluate(Symbols{"label": 10})
+	require.Nil(t, err)
+	require.Equal(t, 11, val)
+	// Nothing is cached, a new value for the symbol is picked up without a
+	// Reset
+	val, err = n.Evaluate(Symbols{"label": 20})
+	require.Nil(t, err)
+	require.Equal(t, 21, val)
+
+	_, err = n.Evaluate(Symbols{})
+	var undef *UndefinedSymbolError
+	require.ErrorAs(t, err, &undef)
+	require.Equal(t, "label", undef.Name)
+
+	lookups := []string{}
+	r := resolverFunc(func(name string) (int, bool, error) {
+		lookups = append(lookups, name)
+		if name == "bad" {
+			return 0, false, fmt.Errorf("bad symbol")
+		}
+		return len(name), true, nil
+	})
+	n, _, e = p.Parse(buf.NewBuffer("abc * max(a, ab) + (0 ? bad : 1)"))
+	require.Nil(t, e)
+	val, err = n.Evaluate(r)
+	require.Nil(t, err)
+	require.Equal(t, 7, val)
+	require.Equal(t, []string{"abc", "a", "ab"}, lookups)
+
+	n, _, e = p.Parse(buf.NewBuffer("1 + bad"))
+	require.Nil(t, e)
+	_, err = n.Evaluate(r)
+	require.EqualError(t, err, "bad symbol")
+}
+
+func TestIdentifiers(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"1 + 2", []string{}},
+		{"a + b * a", []string{"a", "b"}},
+		{"c ? lo(d) : defined(e)", []string{"c", "d", "e"}},
+		{"* - start", []string{"*", "start"}},
+	}
+	for _, tc := range tests {
+		p := Parser{}
+		n, _, e := p.Parse(buf.NewBuffer(tc.input))
+		require.Nil(t, e, tc.input)
+		require.Equal(t, tc.expected, n.Identifiers(), tc.input)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	p := Parser{}
+	n, _, e := p.Parse(buf.NewBuffer("-a * min(2, b)"))
+	require.Nil(t, e)
+	visited := []string{}
+	n.Walk(func(c *Node) bool {
+		switch {
+		case c.Operator() != "":
+			visited = append(visited, c.Operator())
+		default:
+			if v, ok := c.Number(); ok {
+				visited = append(visited, fmt.Sprint(v))
+			} else if name, ok := c.Identifier(); ok {
+				visited = append(visited, name)
+			}
+		}
+		return c.Operator() != "min"
+	})
+	require.Equal(t, []string{"*", "-", "a", "min"}, visited)
+	require.Len(t, n.Children(), 2)
+	require.Len(t, n.Children()[1].Children(), 2)
+}
+
+func TestInfix(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1+2*3", "1 + 2 * 3"},
+		{"(1+2)*3", "(1 + 2) * 3"},
+		{"1-(2-3)", "1 - (2 - 3)"},
+		{"(1-2)-3", "1 - 2 - 3"},
+		{"-(a+1)", "-(a + 1)"},
+		{"<label+1", "<label + 1"},
+		{"<(label+1)", "<(label + 1)"},
+		{"a<b==(c>d)", "a < b == c > d"},
+		{"a ? b : c ? d : e", "a ? b : c ? d : e"},
+		{"(a ? b : c) ? d : e", "(a ? b : c) ? d : e"},
+		{"(a ? b : c) + 1", "(a ? b : c) + 1"},
+		{"min(a+1, $10, %11)", "min(a + 1, 16, 3)"},
+		{`strlen("HI")`, `strlen("HI")`},
+		{"*-2", "* - 2"},
+		{"~$0f & !a", "~15 & !a"},
+		{"1 - -2", "1 - -2"},
+	}
+	for _, tc := range tests {
+		p := Parser{}
+		n, _, e := p.Parse(buf.NewBuffer(tc.input))
+		require.Nil(t, e, tc.input)
+		require.Equal(t, tc.expected, n.Infix(), tc.input)
+
+		// The printed form parses back to the same expression
+		again, remain, e := p.Parse(buf.NewBuffer(n.Infix()))
+		require.Nil(t, e, tc.input)
+		require.True(t, remain.IsEmpty(), tc.input)
+		require.Equal(t, n.String(), again.String(), tc.input)
+	}
+}
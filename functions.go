@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mikerowehl/asm/expr"
+)
+
+// setSizes records size as the size of each of the labels, for sizeof.
+func (a *assembler) setSizes(labels []string, size int) {
+	for _, name := range labels {
+		a.sizes[name] = size
+	}
+}
+
+// defined is the defined(name) expression function. It's worked out when the
+// expression is parsed, so it's 1 only if the symbol is defined on an earlier
+// line, the same as .IFDEF, whether it's used in a condition or an operand.
+func (a *assembler) defined(args []*expr.Node, r expr.Resolver) (int, error) {
+	name, ok := args[0].Identifier()
+	if !ok {
+		return 0, fmt.Errorf("defined needs a symbol name")
+	}
+	if _, found := a.defs[name]; found {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// sizeof is the sizeof(label) expression function, the number of bytes in
+// the instruction or data directive on the line with the label.
+func (a *assembler) sizeof(args []*expr.Node, r expr.Resolver) (int, error) {
+	name, ok := args[0].Identifier()
+	if !ok {
+		return 0, fmt.Errorf("sizeof needs a label")
+	}
+	if _, found := a.constants[name]; found {
+		return 0, fmt.Errorf("sizeof needs a label, %s is a constant", name)
+	}
+	size, found := a.sizes[name]
+	if !found {
+		return 0, &expr.UndefinedSymbolError{Name: name}
+	}
+	return size, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFunctions(t *testing.T) {
+	src := ` .ORG $1000
+ptr = $20
+msg: .TEXT "HELLO"
+start LDX #sizeof(msg)
+ LDA msg-1,X
+ LDA (lo(ptr)),Y
+ JMP max(start, $1000)
+ .BYTE sizeof(start), sizeof(end), hi(msg), defined(msg), defined(nothing)
+end:
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{
+		'H', 'E', 'L', 'L', 'O',
+		0xa2, 0x05,
+		0xbd, 0xff, 0x0f,
+		0xb1, 0x20,
+		0x4c, 0x05, 0x10,
+		0x02, 0x00, 0x10, 0x01, 0x00,
+	}, bytes)
+}
+
+func TestFunctionsInConditions(t *testing.T) {
+	src := ` .ORG $1000
+SIZE = 3
+ .IF defined(SIZE) && !defined(LATER)
+ .BYTE min(SIZE, 2)
+ .ENDIF
+LATER = 1
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{0x02}, bytes)
+}
+
+// TestDefinedLater makes sure defined gives the same answer for a symbol
+// defined further down whether it's in a condition or an operand.
+func TestDefinedLater(t *testing.T) {
+	src := ` .ORG $1000
+ .IF defined(LATER)
+ .BYTE 1
+ .ENDIF
+ .BYTE defined(LATER), defined(EARLIER)
+EARLIER = 1
+ .BYTE defined(LATER), defined(EARLIER)
+LATER = 1
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{0x00, 0x00, 0x00, 0x01}, bytes)
+}
+
+func TestFunctionErrors(t *testing.T) {
+	testCases := []struct {
+		src string
+		err string
+	}{
+		{" .ORG $1000\nC = 1\n .BYTE sizeof(C)\n", "3:2: error: sizeof needs a label, C is a constant"},
+		{" .ORG $1000\n .BYTE sizeof(1)\n", "2:2: error: sizeof needs a label"},
+		{" .ORG $1000\n .BYTE sizeof(nothing)\n", "2:2: error: undefined symbol: nothing"},
+		{" .IF sizeof(x)\n .ENDIF\nx NOP\n", "1:6: error: x is not defined"},
+		{" .BYTE defined(1)\n", "1:8: error: defined needs a symbol name"},
+	}
+	for _, tc := range testCases {
+		a := assembler{}
+		err := a.parseReader(strings.NewReader(tc.src))
+		if err == nil {
+			_, err = a.binaryImage()
+		}
+		require.ErrorContains(t, err, tc.err, tc.src)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mikerowehl/asm/buf"
+	"github.com/mikerowehl/asm/expr"
+)
+
+// parseFilename reads the quoted filename argument of a directive like
+// .INCLUDE, returning the buffer holding it for error reporting and whatever
+// follows it on the line.
+func (a *assembler) parseFilename(op buf.Buffer, line buf.Buffer) (name buf.Buffer, filename string, remain buf.Buffer, err error) {
+	name = line.Advance(line.Scan(buf.Whitespace))
+	if name.IsEmpty() || name.StartsWith(buf.Char(';')) {
+		return name, "", name, errorfAt(op, "%s needs a filename", strings.ToUpper(op.String()))
+	}
+	e, remain, err := a.exprParser.Parse(name)
+	if err != nil {
+		return name, "", remain, errorAt(name, err)
+	}
+	name = name.Trunc(len(name.String()) - len(remain.String()))
+	filename, ok := e.StringValue()
+	if !ok {
+		return name, "", remain, errorfAt(name, "expected a quoted filename")
+	}
+	return name, filename, remain, nil
+}
+
+// findSource locates a file named by a directive. Relative names are looked
+// for first in the directory of the file being parsed, then in each of the
+// include directories in order.
+func (a *assembler) findSource(filename string) (string, error) {
+	if filepath.IsAbs(filename) {
+		return filename, nil
+	}
+	dirs := []string{"."}
+	if a.file != "" && a.file != "<stdin>" {
+		dirs[0] = filepath.Dir(a.file)
+	}
+	dirs = append(dirs, a.includeDirs...)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, filename)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("can't find %s", filename)
+}
+
+// parseInclude handles .INCLUDE "file", parsing the named file in place of
+// the directive. Lines from the included file keep their own file name and
+// line numbers, so diagnostics point into the right file.
+func (a *assembler) parseInclude(op buf.Buffer, line buf.Buffer) error {
+	name, filename, remain, err := a.parseFilename(op, line)
+	if err != nil {
+		return err
+	}
+	remain = remain.Advance(remain.Scan(buf.Whitespace))
+	if !remain.IsEmpty() && !remain.StartsWith(buf.Char(';')) {
+		return errorfAt(remain, "unexpected text %v", remain.String())
+	}
+	path, err := a.findSource(filename)
+	if err != nil {
+		return errorAt(name, err)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return errorAt(name, err)
+	}
+	for i, f := range a.includes {
+		if f == abs {
+			cycle := []string{}
+			for _, c := range append(a.includes[i:], abs) {
+				cycle = append(cycle, filepath.Base(c))
+			}
+			return errorfAt(name, "recursive include: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return errorfAt(name, "can't open %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	prevFile, prevLine := a.file, a.line
+	a.file = path
+	a.includes = append(a.includes, abs)
+	err = a.parseReader(file)
+	a.includes = a.includes[:len(a.includes)-1]
+	a.file, a.line = prevFile, prevLine
+	if err != nil && !errors.As(err, new(Diagnostics)) {
+		return errorfAt(name, "error reading %s: %v", filename, err)
+	}
+	return err
+}
+
+// parseIncbin handles .INCBIN "file"[, offset[, length]], which embeds the
+// bytes of a file in the program, and .INCPRG which does the same for a PRG
+// file, skipping the two byte load address first. The file is read straight
+// away, but the offset and length are expressions that are only evaluated
+// once addresses are being assigned.
+func (a *assembler) parseIncbin(kind PseudoOpKind, op buf.Buffer, line buf.Buffer) error {
+	name, filename, remain, err := a.parseFilename(op, line)
+	if err != nil {
+		return err
+	}
+	remain = remain.Advance(remain.Scan(buf.Whitespace))
+	var args []*expr.Node
+	if remain.StartsWith(buf.Char(',')) {
+		if args, err = a.parseArgs(remain.Advance(1)); err != nil {
+			return err
+		}
+	} else if !remain.IsEmpty() && !remain.StartsWith(buf.Char(';')) {
+		return errorfAt(remain, "unexpected text %v", remain.String())
+	}
+	if len(args) > 2 {
+		return errorfAt(op, "%s takes a filename, offset and length", strings.ToUpper(op.String()))
+	}
+	path, err := a.findSource(filename)
+	if err != nil {
+		return errorAt(name, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return errorfAt(name, "can't read %s: %v", filename, err)
+	}
+	if kind == PseudoIncprg {
+		if len(data) < 2 {
+			return errorfAt(name, "%s is too short to be a PRG file", filename)
+		}
+		data = data[2:]
+	}
+	pseudoNode := PseudoNode{Pseudo: &PseudoOp{Kind: kind, Args: args, file: data}, position: a.position(op)}
+	a.addNode(&pseudoNode)
+	return nil
+}
+
+// incbinRange works out the section of the file embedded by .INCBIN or
+// .INCPRG, from the optional offset and length arguments.
+func (a *assembler) incbinRange(p *PseudoOp) (start int, end int, err error) {
+	end = len(p.file)
+	if len(p.Args) > 0 {
+		if start, err = evaluateCount(p.Args[0], a.sym); err != nil {
+			return 0, 0, err
+		}
+		if start > len(p.file) {
+			return 0, 0, fmt.Errorf("offset %d is past the end of the %d byte file", start, len(p.file))
+		}
+	}
+	if len(p.Args) > 1 {
+		length, err := evaluateCount(p.Args[1], a.sym)
+		if err != nil {
+			return 0, 0, err
+		}
+		if start+length > len(p.file) {
+			return 0, 0, fmt.Errorf("length %d from offset %d runs past the end of the %d byte file", length, start, len(p.file))
+		}
+		end = start + length
+	}
+	return start, end, nil
+}
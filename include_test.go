@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.Nil(t, os.WriteFile(path, []byte(text), 0o644))
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"main.asm":      " .INCLUDE \"vic.inc\"\n .include \"sid.inc\" ; sound\n LDA #0\n STA BORDER\n STA VOLUME\n",
+		"vic.inc":       "BORDER = $D020\n",
+		"lib/sid.inc":   "VOLUME = $D418\n",
+		"other/sid.inc": "VOLUME = 0\n",
+	})
+	a := assembler{includeDirs: []string{filepath.Join(dir, "lib"), filepath.Join(dir, "other")}}
+	require.Nil(t, a.parseFile(filepath.Join(dir, "main.asm")))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{0xa9, 0x00, 0x8d, 0x20, 0xd0, 0x8d, 0x18, 0xd4}, bytes)
+	require.Equal(t, Position{File: filepath.Join(dir, "vic.inc"), Line: 1, Col: 1}, a.defs["BORDER"])
+	require.Equal(t, Position{File: filepath.Join(dir, "lib", "sid.inc"), Line: 1, Col: 1}, a.defs["VOLUME"])
+}
+
+func TestIncludeErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"loop.asm":    " NOP\n .INCLUDE \"a.inc\"\n",
+		"a.inc":       " .INCLUDE \"b.inc\"\n",
+		"b.inc":       " .INCLUDE \"loop.asm\"\n",
+		"missing.asm": " .INCLUDE \"nothere.inc\"\n",
+		"bad.asm":     " NOP\n .INCLUDE \"bad.inc\"\n STZ $10\n",
+		"bad.inc":     "\n LDX #1\n FOO\n",
+		"noname.asm":  " .INCLUDE\n .INCLUDE 5\n",
+	})
+	testCases := []struct {
+		file     string
+		expected string
+	}{
+		{"loop.asm", filepath.Join(dir, "b.inc") + ":1:11: error: recursive include: loop.asm -> a.inc -> b.inc -> loop.asm"},
+		{"missing.asm", filepath.Join(dir, "missing.asm") + ":1:11: error: can't find nothere.inc"},
+		{"bad.asm", filepath.Join(dir, "bad.inc") + ":3:2: error: FOO is not a valid instruction\n" +
+			filepath.Join(dir, "bad.asm") + ":3:2: error: STZ is not a valid instruction"},
+		{"noname.asm", filepath.Join(dir, "noname.asm") + ":1:2: error: .INCLUDE needs a filename\n" +
+			filepath.Join(dir, "noname.asm") + ":2:11: error: expected a quoted filename"},
+	}
+	for _, tc := range testCases {
+		a := assembler{}
+		err := a.parseFile(filepath.Join(dir, tc.file))
+		require.NotNil(t, err, tc.file)
+		require.Equal(t, tc.expected, err.Error(), tc.file)
+	}
+}
+
+func TestIncbin(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"sprite.bin": "\x01\x02\x03\x04\x05",
+		"tune.prg":   "\x00\x10\xaa\xbb\xcc",
+	})
+	testCases := []struct {
+		src      string
+		expected []uint8
+	}{
+		{" .INCBIN \"sprite.bin\"\n", []uint8{1, 2, 3, 4, 5}},
+		{" .INCBIN \"sprite.bin\", 3 ; tail\n", []uint8{4, 5}},
+		{"SKIP = 1\n .incbin \"sprite.bin\", SKIP, 2\n NOP\n", []uint8{2, 3, 0xea}},
+		{" .INCBIN \"sprite.bin\", END, 0\nEND = 5\n", []uint8{}},
+		{" .INCPRG \"tune.prg\"\n", []uint8{0xaa, 0xbb, 0xcc}},
+		{" .INCPRG \"tune.prg\", 1, 1\n", []uint8{0xbb}},
+	}
+	for _, tc := range testCases {
+		a := assembler{includeDirs: []string{dir}}
+		require.Nil(t, a.parseReader(strings.NewReader(tc.src)), tc.src)
+		bytes, err := a.binaryImage()
+		require.Nil(t, err, tc.src)
+		require.Equal(t, tc.expected, bytes, tc.src)
+	}
+}
+
+func TestIncbinErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"one.bin": "\x01"})
+	parseErrors := []struct {
+		src      string
+		expected string
+	}{
+		{" .INCBIN \"none.bin\"\n", "1:10: error: can't find none.bin"},
+		{" .INCBIN \"one.bin\" 3\n", "1:20: error: unexpected text 3"},
+		{" .INCBIN \"one.bin\", 1, 2, 3\n", "1:2: error: .INCBIN takes a filename, offset and length"},
+		{" .INCPRG \"one.bin\"\n", "1:10: error: one.bin is too short to be a PRG file"},
+	}
+	for _, tc := range parseErrors {
+		a := assembler{includeDirs: []string{dir}}
+		err := a.parseReader(strings.NewReader(tc.src))
+		require.NotNil(t, err, tc.src)
+		require.Equal(t, tc.expected, err.Error(), tc.src)
+	}
+	assembleErrors := []struct {
+		src      string
+		expected string
+	}{
+		{" .INCBIN \"one.bin\", 2\n", "offset 2 is past the end of the 1 byte file"},
+		{" .INCBIN \"one.bin\", 0, 2\n", "length 2 from offset 0 runs past the end of the 1 byte file"},
+		{" .INCBIN \"one.bin\", -1\n", "negative count -1"},
+	}
+	for _, tc := range assembleErrors {
+		a := assembler{includeDirs: []string{dir}}
+		require.Nil(t, a.parseReader(strings.NewReader(tc.src)), tc.src)
+		_, err := a.binaryImage()
+		require.ErrorContains(t, err, tc.expected, tc.src)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// sourceLine is a line of source text along with the nodes parsed from it,
+// kept so the listing can show what each line turned into.
+type sourceLine struct {
+	pos   Position
+	text  string
+	nodes []Node
+}
+
+// listingBytesPerRow is the number of bytes shown on each row of the listing.
+// Lines that emit more than this wrap onto extra rows with just the address
+// and bytes.
+const listingBytesPerRow = 4
+
+// listingDetails works out what to show in the listing for a line. addr is
+// the address the line assembled at, or the value for a constant. cycles is
+// zero for anything other than instructions.
+func (a *assembler) listingDetails(l *sourceLine) (addr string, start int, mem []uint8, cycles int) {
+	emitted := false
+	for _, node := range l.nodes {
+		switch n := node.(type) {
+		case *LabelNode:
+			if val, found := a.sym[n.Name]; found && addr == "" {
+				addr = fmt.Sprintf("%04X", val)
+				start = val
+			}
+		case *ConstNode:
+			if val, found := a.sym[n.Names[0]]; found {
+				addr = fmt.Sprintf("=%04X", val)
+			}
+		case *InstructionNode:
+			if !emitted {
+				start = n.inst.chunk.addr
+				addr = fmt.Sprintf("%04X", start)
+				emitted = true
+			}
+			mem = append(mem, n.inst.chunk.mem...)
+			cycles += a.instructionCycles(n.inst)
+		case *PseudoNode:
+			if len(n.Pseudo.chunk.mem) == 0 {
+				continue
+			}
+			if !emitted {
+				start = n.Pseudo.chunk.addr
+				addr = fmt.Sprintf("%04X", start)
+				emitted = true
+			}
+			mem = append(mem, n.Pseudo.chunk.mem...)
+		}
+	}
+	return
+}
+
+// instructionCycles returns the base cycle count for an assembled
+// instruction. A long branch counts the inverted branch and the JMP.
+func (a *assembler) instructionCycles(in *inst) int {
+	form, err := instructionEntry(in.op, in.mode)
+	if err != nil {
+		return 0
+	}
+	if in.long {
+		jmp, err := instructionEntry(JMP, Absolute)
+		if err != nil {
+			return 0
+		}
+		return int(form.cycles) + int(jmp.cycles)
+	}
+	return int(form.cycles)
+}
+
+// writeListing writes a listing of the assembled program, one row for every
+// line of source with the address, bytes and cycle count for it:
+//
+//	LINE  ADDR   BYTES        CYC  SOURCE
+//	   4  1000   A9 04          2  start: lda #4
+func (a *assembler) writeListing(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%5s  %-5s  %-11s  %3s  %s\n", "LINE", "ADDR", "BYTES", "CYC", "SOURCE")
+	for _, l := range a.lines {
+		addr, start, mem, cycles := a.listingDetails(l)
+		cyc := ""
+		if cycles > 0 {
+			cyc = fmt.Sprintf("%d", cycles)
+		}
+		row := mem[:min(len(mem), listingBytesPerRow)]
+		fmt.Fprintf(bw, "%5d  %-5s  %-11s  %3s  %s\n", l.pos.Line, addr, fmt.Sprintf("% X", row), cyc, l.text)
+		for i := listingBytesPerRow; i < len(mem); i += listingBytesPerRow {
+			row = mem[i:min(len(mem), i+listingBytesPerRow)]
+			fmt.Fprintf(bw, "%5s  %04X   %s\n", "", start+i, fmt.Sprintf("% X", row))
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListing(t *testing.T) {
+	src := `; demo
+SCREEN = $0400
+ .ORG $1000
+start: lda #4
+ sta SCREEN,x
+ bne start
+table: .byte 1,2,3,4,5,6,7,8,9
+`
+	expected := ` LINE  ADDR   BYTES        CYC  SOURCE
+    1                           ; demo
+    2  =0400                    SCREEN = $0400
+    3                            .ORG $1000
+    4  1000   A9 04          2  start: lda #4
+    5  1002   9D 00 04       5   sta SCREEN,x
+    6  1005   D0 F9          2   bne start
+    7  1007   01 02 03 04       table: .byte 1,2,3,4,5,6,7,8,9
+       100B   05 06 07 08
+       100F   09
+`
+	a := assembler{}
+	err := a.parseReader(strings.NewReader(src))
+	require.Nil(t, err)
+	_, err = a.binaryImage()
+	require.Nil(t, err)
+	var out strings.Builder
+	err = a.writeListing(&out)
+	require.Nil(t, err)
+	require.Equal(t, expected, out.String())
+}
+
+// TestListingLabelConst makes sure a label on its own line that becomes a
+// constant is listed with the constant's value, not as an address.
+func TestListingLabelConst(t *testing.T) {
+	src := ` .ORG $1000
+FOO
+BAR = 5
+ NOP
+`
+	expected := ` LINE  ADDR   BYTES        CYC  SOURCE
+    1                            .ORG $1000
+    2                           FOO
+    3  =0005                    BAR = 5
+    4  1000   EA             2   NOP
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	_, err := a.binaryImage()
+	require.Nil(t, err)
+	var out strings.Builder
+	require.Nil(t, a.writeListing(&out))
+	require.Equal(t, expected, out.String())
+}
+
+func TestListingLongBranchCycles(t *testing.T) {
+	a := assembler{longBranches: true}
+	err := a.parseReader(strings.NewReader(" BNE far\n .RES 200\nfar: RTS\n"))
+	require.Nil(t, err)
+	_, err = a.binaryImage()
+	require.Nil(t, err)
+	_, _, mem, cycles := a.listingDetails(a.lines[0])
+	require.Len(t, mem, 5)
+	require.Equal(t, 5, cycles)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mikerowehl/asm/buf"
+)
+
+// maxIterations limits how many times a single .REPEAT or .FOR block can
+// repeat, to catch loops with runaway bounds.
+const maxIterations = 65536
+
+// loop is a .REPEAT or .FOR block being recorded. The body is kept until the
+// matching .ENDR and then parsed once for every iteration. Labels defined in
+// the body are local to each iteration the same way as in a macro.
+type loop struct {
+	counter string // Name of the .FOR counter, empty for .REPEAT
+	values  []int  // Counter value for each iteration
+	body    []macroLine
+	nested  int // Depth of loops inside the body while recording
+	pos     Position
+}
+
+// counter returns the value of a loop counter in the iteration being parsed.
+func (a *assembler) counter(name string) (int, bool) {
+	val, found := a.counters[name]
+	return val, found
+}
+
+// startLoop begins recording a .REPEAT or .FOR block. A loop with a bad
+// header is still recorded, with no iterations, so the lines up to its .ENDR
+// don't cause more errors.
+func (a *assembler) startLoop(kind PseudoOpKind, op buf.Buffer, line buf.Buffer) error {
+	var l *loop
+	var err error
+	if kind == PseudoRepeat {
+		l, err = a.parseRepeat(op, line)
+	} else {
+		l, err = a.parseFor(op, line)
+	}
+	if err != nil {
+		l = &loop{pos: a.position(op)}
+	}
+	a.repeating = l
+	return err
+}
+
+// parseRepeat starts a block repeated a fixed number of times:
+//
+//	.REPEAT 8
+func (a *assembler) parseRepeat(op buf.Buffer, line buf.Buffer) (*loop, error) {
+	line = line.Advance(line.Scan(buf.Whitespace))
+	if line.IsEmpty() || line.StartsWith(buf.Char(';')) {
+		return nil, errorfAt(op, ".REPEAT needs a count")
+	}
+	count, remain, err := a.evaluateNow(line, "repeat counts")
+	if err != nil {
+		return nil, err
+	}
+	if err = a.checkEnd(remain); err != nil {
+		return nil, err
+	}
+	if count < 0 || count > maxIterations {
+		return nil, errorfAt(line, "repeat count %d is outside 0 to %d", count, maxIterations)
+	}
+	return &loop{values: make([]int, count), pos: a.position(op)}, nil
+}
+
+// parseFor starts a block repeated with a counter running from start to end
+// inclusive, stepping by 1 unless a step is given:
+//
+//	.FOR i = 0, 255, 4
+//
+// The counter can be used in expressions inside the block.
+func (a *assembler) parseFor(op buf.Buffer, line buf.Buffer) (*loop, error) {
+	line = line.Advance(line.Scan(buf.Whitespace))
+	name, remain := line.TakeIdentifier()
+	if name.IsEmpty() {
+		return nil, errorfAt(op, ".FOR needs a counter name")
+	}
+	remain = remain.Advance(remain.Scan(buf.Whitespace))
+	if !remain.StartsWith(buf.Char('=')) {
+		return nil, errorfAt(remain, "expected = after the counter name")
+	}
+	remain = remain.Advance(1)
+	remain = remain.Advance(remain.Scan(buf.Whitespace))
+	bounds := []int{}
+	for len(bounds) < 3 && !remain.IsEmpty() && !remain.StartsWith(buf.Char(';')) {
+		val, rest, err := a.evaluateNow(remain, "loop bounds")
+		if err != nil {
+			return nil, err
+		}
+		bounds = append(bounds, val)
+		remain = rest
+		if !remain.StartsWith(buf.Char(',')) {
+			break
+		}
+		remain = remain.Advance(1)
+		remain = remain.Advance(remain.Scan(buf.Whitespace))
+	}
+	if err := a.checkEnd(remain); err != nil {
+		return nil, err
+	}
+	if len(bounds) < 2 {
+		return nil, errorfAt(op, ".FOR needs a start and end")
+	}
+	start, end, step := bounds[0], bounds[1], 1
+	if len(bounds) == 3 {
+		step = bounds[2]
+	}
+	if step == 0 {
+		return nil, errorfAt(op, ".FOR step can't be 0")
+	}
+	l := &loop{counter: name.String(), pos: a.position(op)}
+	for i := start; (step > 0 && i <= end) || (step < 0 && i >= end); i += step {
+		if len(l.values) == maxIterations {
+			return nil, errorfAt(op, ".FOR repeats more than %d times", maxIterations)
+		}
+		l.values = append(l.values, i)
+	}
+	return l, nil
+}
+
+// recordLoopLine adds a line to the body of the loop being recorded, or runs
+// the loop at the .ENDR that finishes it.
+func (a *assembler) recordLoopLine(line buf.Buffer) error {
+	l := a.repeating
+	_, op, _ := lineOperation(line)
+	switch strings.ToUpper(op.String()) {
+	case ".REPEAT", ".FOR":
+		l.nested++
+	case ".ENDR":
+		if l.nested == 0 {
+			a.repeating = nil
+			return a.runLoop(l)
+		}
+		l.nested--
+	}
+	l.body = append(l.body, macroLine{text: line.String(), pos: a.position(line)})
+	return nil
+}
+
+// runLoop parses the body of a loop for each iteration. Parsing stops after
+// the first iteration with errors, since the rest would repeat them.
+func (a *assembler) runLoop(l *loop) error {
+	locals := []string{}
+	for _, bl := range l.body {
+		label, _ := takeLabel(buf.NewBuffer(bl.text))
+		if !label.IsEmpty() {
+			locals = append(locals, label.String())
+		}
+	}
+	if a.counters == nil {
+		a.counters = map[string]int{}
+	}
+	prevFile, prevLine, prevLocals, prevScope := a.file, a.line, a.locals, a.scope
+	prevCounter, shadowed := a.counters[l.counter]
+	a.exprParser.Lookup = a.counter
+	depth := len(a.conds)
+	var diags Diagnostics
+	for _, val := range l.values {
+		a.expansions++
+		a.locals = map[string]string{}
+		for name, local := range prevLocals {
+			a.locals[name] = local
+		}
+		for _, name := range locals {
+			a.locals[name] = fmt.Sprintf("%s@%d", name, a.expansions)
+		}
+		if l.counter != "" {
+			a.counters[l.counter] = val
+		}
+		for _, bl := range l.body {
+			a.file, a.line = bl.pos.File, bl.pos.Line
+			diags = append(diags, a.parseSourceLine(bl.text)...)
+		}
+		diags = append(diags, a.checkConditionals(depth)...)
+		if len(diags) > 0 {
+			break
+		}
+	}
+	if shadowed {
+		a.counters[l.counter] = prevCounter
+	} else {
+		delete(a.counters, l.counter)
+	}
+	a.file, a.line, a.locals, a.scope = prevFile, prevLine, prevLocals, prevScope
+	return diags.err()
+}
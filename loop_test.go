@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoops(t *testing.T) {
+	testCases := []struct {
+		src      string
+		expected []uint8
+	}{
+		{" .REPEAT 3\n NOP\n .ENDR\n", []uint8{0xea, 0xea, 0xea}},
+		{" .REPEAT 0\n NOP\n .ENDR\n", []uint8{}},
+		{"N = 2\n .repeat N*2 ; unrolled\n INX\n .endr\n", []uint8{0xe8, 0xe8, 0xe8, 0xe8}},
+		{" .FOR i = 0, 3\n .BYTE i*i\n .ENDR\n", []uint8{0, 1, 4, 9}},
+		{" .FOR i = 10, 0, -5\n .BYTE i\n .ENDR\n", []uint8{10, 5, 0}},
+		{" .FOR i = 0, 4, 2\n .FOR j = 0, 1\n .BYTE i+j\n .ENDR\n .ENDR\n", []uint8{0, 1, 2, 3, 4, 5}},
+		{" .FOR i = 0, 2\n .IF i != 1\n .BYTE i\n .ENDIF\n .ENDR\n", []uint8{0, 2}},
+		{"i = 7\n .FOR i = 0, 1\n .BYTE i\n .ENDR\n .BYTE i\n", []uint8{0, 1, 7}},
+		{" .FOR col = 0, 1\n LDA #col\n STA $d800+col\n .ENDR\n", []uint8{0xa9, 0x00, 0x8d, 0x00, 0xd8, 0xa9, 0x01, 0x8d, 0x01, 0xd8}},
+	}
+	for _, tc := range testCases {
+		a := assembler{}
+		require.Nil(t, a.parseReader(strings.NewReader(tc.src)), tc.src)
+		bytes, err := a.binaryImage()
+		require.Nil(t, err, tc.src)
+		require.Equal(t, tc.expected, bytes, tc.src)
+	}
+}
+
+func TestLoopLocalLabels(t *testing.T) {
+	src := ` .ORG $1000
+ .REPEAT 2
+ LDX #2
+wait: DEX
+ BNE wait
+ .ENDR
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{0xa2, 0x02, 0xca, 0xd0, 0xfd, 0xa2, 0x02, 0xca, 0xd0, 0xfd}, bytes)
+	require.Equal(t, 0x1002, a.sym["wait@1"])
+	require.Equal(t, 0x1007, a.sym["wait@2"])
+}
+
+func TestLoopErrors(t *testing.T) {
+	testCases := []struct {
+		src      string
+		expected string
+	}{
+		{" .REPEAT\n .ENDR\n", "1:2: error: .REPEAT needs a count"},
+		{" .REPEAT -1\n .ENDR\n", "1:10: error: repeat count -1 is outside 0 to 65536"},
+		{" .REPEAT COUNT\n .ENDR\nCOUNT = 2\n", "1:10: error: COUNT is not defined, repeat counts can't refer to symbols defined later"},
+		{" .REPEAT 2\n NOP\n", "1:2: error: missing .ENDR"},
+		{" .ENDR\n", "1:2: error: .ENDR without .REPEAT or .FOR"},
+		{" .FOR\n .ENDR\n", "1:2: error: .FOR needs a counter name"},
+		{" .FOR i 0, 1\n .ENDR\n", "1:9: error: expected = after the counter name"},
+		{" .FOR i = 0\n .ENDR\n", "1:2: error: .FOR needs a start and end"},
+		{" .FOR i = 0, 1, 0\n .ENDR\n", "1:2: error: .FOR step can't be 0"},
+		{" .FOR i = 0, 100000\n .ENDR\n", "1:2: error: .FOR repeats more than 65536 times"},
+		{" .REPEAT 3\n STZ $10\n .ENDR\n", "2:2: error: STZ is not a valid instruction"},
+		{" .REPEAT 2\n .IF 1\n .ENDR\n", "2:2: error: missing .ENDIF"},
+	}
+	for _, tc := range testCases {
+		a := assembler{}
+		err := a.parseReader(strings.NewReader(tc.src))
+		require.NotNil(t, err, tc.src)
+		require.Equal(t, tc.expected, err.Error(), tc.src)
+	}
+}
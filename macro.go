@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mikerowehl/asm/buf"
+)
+
+// maxMacroDepth is how deeply macro calls can nest, which catches macros that
+// end up calling themselves.
+const maxMacroDepth = 16
+
+// macroParam is a parameter of a macro. Parameters with a default can be left
+// out of a call.
+type macroParam struct {
+	name       string
+	def        string
+	hasDefault bool
+}
+
+// macroLine is a line from the body of a macro, along with where it was
+// defined so diagnostics can point back at it.
+type macroLine struct {
+	text string
+	pos  Position
+}
+
+// macro is a sequence of lines defined between .MACRO and .ENDM, which are
+// parsed in place of each call. Parameters are written \name in the body and
+// replaced with the text of the argument. Labels defined in the body are
+// local, every expansion gets its own copy of them.
+type macro struct {
+	name   string
+	params []macroParam
+	body   []macroLine
+	locals []string
+	pos    Position
+}
+
+// trimSpace removes whitespace from both ends of a buffer.
+func trimSpace(b buf.Buffer) buf.Buffer {
+	b = b.Advance(b.Scan(buf.Whitespace))
+	return b.Trunc(len(strings.TrimRight(b.String(), " \t")))
+}
+
+// isCharLiteral checks for a character literal like ';' at the start of s,
+// which shouldn't be taken for a comment or the end of an argument.
+func isCharLiteral(s string) bool {
+	return len(s) >= 3 && s[0] == '\'' && s[2] == '\''
+}
+
+// splitArgs splits a list of macro arguments or parameters at the commas
+// between them. Commas inside quotes, character literals or parentheses don't
+// split, and the list ends at a comment.
+func splitArgs(line buf.Buffer) []buf.Buffer {
+	args := []buf.Buffer{}
+	s := line.String()
+	start, end, depth, quoted := 0, len(s), 0, false
+scan:
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case isCharLiteral(s[i:]):
+			i += 2
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, trimSpace(line.Advance(start).Trunc(i-start)))
+			start = i + 1
+		case c == ';':
+			end = i
+			break scan
+		}
+	}
+	last := trimSpace(line.Advance(start).Trunc(end - start))
+	if len(args) > 0 || !last.IsEmpty() {
+		args = append(args, last)
+	}
+	return args
+}
+
+// parseMacro starts the definition of a macro:
+//
+//	.MACRO addw dst, src, carry=0
+//
+// Every line up to the matching .ENDM is stored as the body.
+func (a *assembler) parseMacro(op buf.Buffer, line buf.Buffer) error {
+	remain := line.Advance(line.Scan(buf.Whitespace))
+	name, remain := remain.TakeIdentifier()
+	if name.IsEmpty() {
+		return errorfAt(op, ".MACRO needs a name")
+	}
+	if _, err := ToInstruction(strings.ToUpper(name.String())); err == nil {
+		return errorfAt(name, "macro name %s is an instruction", name)
+	}
+	if prev, found := a.macros[name.String()]; found {
+		return errorfAt(name, "macro %s redefined, first defined at %s", name, prev.pos)
+	}
+	m := &macro{name: name.String(), pos: a.position(name)}
+	for _, arg := range splitArgs(remain) {
+		param, rest := arg.TakeIdentifier()
+		if param.IsEmpty() || !(rest.IsEmpty() || rest.StartsWith(buf.Char('='))) {
+			return errorfAt(arg, "bad macro parameter %s", arg)
+		}
+		for _, p := range m.params {
+			if p.name == param.String() {
+				return errorfAt(param, "duplicate macro parameter %s", param)
+			}
+		}
+		p := macroParam{name: param.String()}
+		if !rest.IsEmpty() {
+			p.def = trimSpace(rest.Advance(1)).String()
+			p.hasDefault = true
+		}
+		m.params = append(m.params, p)
+	}
+	a.defining = m
+	return nil
+}
+
+// recordMacroLine adds a line to the body of the macro being defined, or
+// finishes the definition at .ENDM.
+func (a *assembler) recordMacroLine(line buf.Buffer) error {
+	_, op, _ := lineOperation(line)
+	switch strings.ToUpper(op.String()) {
+	case ".ENDM":
+		a.endMacro()
+		return nil
+	case ".MACRO":
+		return errorfAt(op, "macro definitions can't be nested, missing .ENDM for %s", a.defining.name)
+	}
+	a.defining.body = append(a.defining.body, macroLine{text: line.String(), pos: a.position(line)})
+	return nil
+}
+
+// endMacro finishes the macro being defined, collecting the labels defined in
+// its body so they can be made local to each expansion.
+func (a *assembler) endMacro() {
+	m := a.defining
+	a.defining = nil
+	seen := map[string]bool{}
+	for _, l := range m.body {
+		label, _ := takeLabel(buf.NewBuffer(l.text))
+		if !label.IsEmpty() && !seen[label.String()] {
+			seen[label.String()] = true
+			m.locals = append(m.locals, label.String())
+		}
+	}
+	if a.macros == nil {
+		a.macros = map[string]*macro{}
+	}
+	a.macros[m.name] = m
+}
+
+// macroArgs matches the arguments of a call up with the parameters of the
+// macro. Arguments are given in order, by name as param=value, or a mix with
+// the named ones last.
+func (m *macro) macroArgs(op buf.Buffer, line buf.Buffer) (map[string]string, error) {
+	values := map[string]string{}
+	named := false
+	for i, arg := range splitArgs(line) {
+		name, rest := arg.TakeIdentifier()
+		if !name.IsEmpty() && rest.StartsWith(buf.Char('=')) && !rest.StartsWith(buf.Str("==")) {
+			found := false
+			for _, p := range m.params {
+				found = found || p.name == name.String()
+			}
+			if !found {
+				return nil, errorfAt(name, "macro %s has no parameter %s", m.name, name)
+			}
+			if _, dup := values[name.String()]; dup {
+				return nil, errorfAt(name, "argument %s given more than once", name)
+			}
+			values[name.String()] = trimSpace(rest.Advance(1)).String()
+			named = true
+			continue
+		}
+		if named {
+			return nil, errorfAt(arg, "positional argument after named arguments")
+		}
+		if i >= len(m.params) {
+			return nil, errorfAt(arg, "too many arguments for macro %s, expected %d", m.name, len(m.params))
+		}
+		if !arg.IsEmpty() {
+			values[m.params[i].name] = arg.String()
+		}
+	}
+	for _, p := range m.params {
+		if _, found := values[p.name]; found {
+			continue
+		}
+		if !p.hasDefault {
+			return nil, errorfAt(op, "missing argument %s for macro %s", p.name, m.name)
+		}
+		values[p.name] = p.def
+	}
+	return values, nil
+}
+
+// substituteParams replaces each \name in a line of a macro body with the
+// value of the parameter. Comments are left alone.
+func substituteParams(text string, values map[string]string) (string, error) {
+	var sb strings.Builder
+	quoted := false
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case !quoted && isCharLiteral(text[i:]):
+			sb.WriteString(text[i : i+3])
+			i += 2
+			continue
+		case c == ';' && !quoted:
+			sb.WriteString(text[i:])
+			return sb.String(), nil
+		case c == '\\':
+			name, _ := buf.NewBuffer(text[i+1:]).TakeIdentifier()
+			val, found := values[name.String()]
+			if !found {
+				return "", fmt.Errorf("unknown macro parameter \\%s", name)
+			}
+			sb.WriteString(val)
+			i += len(name.String())
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String(), nil
+}
+
+// expandMacro parses the body of a macro in place of a call to it. Each line
+// keeps the position it had in the definition, with the call recorded as the
+// expansion so diagnostics can show both.
+func (a *assembler) expandMacro(m *macro, op buf.Buffer, line buf.Buffer) error {
+	nesting := 0
+	for e := a.expansion; e != nil; e = e.Call.Expansion {
+		nesting++
+	}
+	if nesting >= maxMacroDepth {
+		return errorfAt(op, "macro %s nested more than %d deep", m.name, maxMacroDepth)
+	}
+	values, err := m.macroArgs(op, line)
+	if err != nil {
+		return err
+	}
+	a.expansions++
+	locals := map[string]string{}
+	for _, l := range m.locals {
+		locals[l] = fmt.Sprintf("%s@%d", l, a.expansions)
+	}
+
+	prevFile, prevLine, prevExpansion, prevLocals, prevScope := a.file, a.line, a.expansion, a.locals, a.scope
+	a.expansion = &Expansion{Macro: m.name, Call: a.position(op)}
+	a.locals = locals
+	depth := len(a.conds)
+	var diags Diagnostics
+	for _, l := range m.body {
+		a.file, a.line = l.pos.File, l.pos.Line
+		text, err := substituteParams(l.text, values)
+		if err != nil {
+			diags = append(diags, diagnosticAt(a.position(buf.NewBuffer(l.text)), err))
+			continue
+		}
+		diags = append(diags, a.parseSourceLine(text)...)
+	}
+	diags = append(diags, a.checkConditionals(depth)...)
+	a.file, a.line, a.expansion, a.locals, a.scope = prevFile, prevLine, prevExpansion, prevLocals, prevScope
+	return diags.err()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mikerowehl/asm/buf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitArgs(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected []string
+	}{
+		{"", []string{}},
+		{"  ; comment", []string{}},
+		{"a", []string{"a"}},
+		{" a , (b,c) ,\"x,y\" ; d, e", []string{"a", "(b,c)", "\"x,y\""}},
+		{"a,,b", []string{"a", "", "b"}},
+		{"',', ';' ; c", []string{"','", "';'"}},
+	}
+	for _, tc := range testCases {
+		args := []string{}
+		for _, arg := range splitArgs(buf.NewBuffer(tc.input)) {
+			args = append(args, arg.String())
+		}
+		require.Equal(t, tc.expected, args, tc.input)
+	}
+}
+
+func TestMacroExpansion(t *testing.T) {
+	src := ` .ORG $1000
+ .MACRO addw dst, src, carry=CLC
+ \carry
+ LDA \dst
+ ADC #<\src
+ STA \dst
+ .ENDM
+ .MACRO wait count
+ LDX #\count
+loop: DEX
+ BNE loop
+ .ENDM
+start: addw $10, $0102
+ addw src=3, dst=$20, carry=SEC
+ wait 5
+ wait count=2
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{
+		0x18, 0xa5, 0x10, 0x69, 0x02, 0x85, 0x10,
+		0x38, 0xa5, 0x20, 0x69, 0x03, 0x85, 0x20,
+		0xa2, 0x05, 0xca, 0xd0, 0xfd,
+		0xa2, 0x02, 0xca, 0xd0, 0xfd,
+	}, bytes)
+	require.Equal(t, 0x1000, a.sym["start"])
+	require.Equal(t, 0x1010, a.sym["loop@3"])
+	require.Equal(t, 0x1015, a.sym["loop@4"])
+	require.NotContains(t, a.sym, "loop")
+}
+
+func TestNestedMacros(t *testing.T) {
+	src := ` .MACRO inner val
+ LDA #\val
+ .ENDM
+ .MACRO outer val
+ inner \val
+ inner \val+1
+ .ENDM
+ outer 7
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{0xa9, 0x07, 0xa9, 0x08}, bytes)
+}
+
+func TestMacroErrors(t *testing.T) {
+	testCases := []struct {
+		src      string
+		expected string
+	}{
+		{" .MACRO\n", "1:2: error: .MACRO needs a name"},
+		{" .MACRO lda\n .ENDM\n", "1:9: error: macro name lda is an instruction"},
+		{" .MACRO m a, a\n .ENDM\n", "1:14: error: duplicate macro parameter a"},
+		{" .MACRO m 3\n .ENDM\n", "1:11: error: bad macro parameter 3"},
+		{" .MACRO m\n .ENDM\n .MACRO m\n .ENDM\n", "3:9: error: macro m redefined, first defined at 1:9"},
+		{" .MACRO m\n NOP\n", "1:9: error: missing .ENDM for macro m"},
+		{" .MACRO m\n .MACRO n\n .ENDM\n", "2:2: error: macro definitions can't be nested, missing .ENDM for m"},
+		{" .ENDM\n", "1:2: error: .ENDM without .MACRO"},
+		{" .MACRO m a\n .ENDM\n m\n", "3:2: error: missing argument a for macro m"},
+		{" .MACRO m a\n .ENDM\n m 1, 2\n", "3:7: error: too many arguments for macro m, expected 1"},
+		{" .MACRO m a\n .ENDM\n m b=1\n", "3:4: error: macro m has no parameter b"},
+		{" .MACRO m a\n .ENDM\n m a=1, a=2\n", "3:9: error: argument a given more than once"},
+		{" .MACRO m a, b\n .ENDM\n m a=1, 2\n", "3:9: error: positional argument after named arguments"},
+		{" .MACRO m a\n LDA \\b\n .ENDM\n m 1\n", "2:1: error: unknown macro parameter \\b\n4:2: note: in expansion of macro m"},
+		{" .MACRO m\n STZ $10\n .ENDM\n .MACRO n\n m\n .ENDM\n n\n",
+			"2:2: error: STZ is not a valid instruction\n5:2: note: in expansion of macro m\n7:2: note: in expansion of macro n"},
+		{" .MACRO m\n m\n .ENDM\n m\n", "2:2: error: macro m nested more than 16 deep"},
+	}
+	for _, tc := range testCases {
+		a := assembler{}
+		err := a.parseReader(strings.NewReader(tc.src))
+		require.NotNil(t, err, tc.src)
+		require.True(t, strings.HasPrefix(err.Error(), tc.expected), "%s\n%s", tc.src, err)
+	}
+}
+
+func TestMacroAssemblyError(t *testing.T) {
+	src := ` .MACRO store val
+ LDA #\val
+ .ENDM
+ store 300
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	_, err := a.binaryImage()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "2:2: error: ")
+	require.Contains(t, err.Error(), "\n4:2: note: in expansion of macro store")
+}
+
+func TestMacroKeepsLocalScope(t *testing.T) {
+	src := ` .MACRO delay16
+wait: DEX
+ BNE wait
+ .ENDM
+main: LDX #0
+ delay16
+ BEQ @done
+@done: RTS
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	_, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, 7, a.sym["main@done"])
+}
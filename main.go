@@ -2,10 +2,12 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/mikerowehl/asm/buf"
@@ -37,6 +39,7 @@ const (
 	CPY
 	DEC
 	DEX
+	DEY
 	EOR
 	INC
 	INX
@@ -95,6 +98,7 @@ var InstructionStrings = []string{
 	"CPY",
 	"DEC",
 	"DEX",
+	"DEY",
 	"EOR",
 	"INC",
 	"INX",
@@ -167,51 +171,273 @@ type OpcodeForm struct {
 	mode   AddressingMode
 	opcode uint8
 	bytes  uint8 // Length of this form of the instruction
+	cycles uint8 // Base cycle count, not including page crossings or taken branches
 }
 
 // Built out from http://www.6502.org/users/obelisk/6502/reference.html
 var InstructionSet = map[Instruction][]OpcodeForm{
 	ADC: {
-		{mode: Immediate, opcode: 0x69, bytes: 2},
-		{mode: Zeropage, opcode: 0x65, bytes: 2},
-		{mode: ZeropageXIndexed, opcode: 0x75, bytes: 2},
-		{mode: Absolute, opcode: 0x6d, bytes: 3},
-		{mode: AbsoluteXIndex, opcode: 0x7d, bytes: 3},
-		{mode: AbsoluteYIndex, opcode: 0x79, bytes: 3},
-		{mode: XIndexedIndirect, opcode: 0x61, bytes: 2},
-		{mode: IndirectYIndexed, opcode: 0x71, bytes: 2},
+		{mode: Immediate, opcode: 0x69, bytes: 2, cycles: 2},
+		{mode: Zeropage, opcode: 0x65, bytes: 2, cycles: 3},
+		{mode: ZeropageXIndexed, opcode: 0x75, bytes: 2, cycles: 4},
+		{mode: Absolute, opcode: 0x6d, bytes: 3, cycles: 4},
+		{mode: AbsoluteXIndex, opcode: 0x7d, bytes: 3, cycles: 4},
+		{mode: AbsoluteYIndex, opcode: 0x79, bytes: 3, cycles: 4},
+		{mode: XIndexedIndirect, opcode: 0x61, bytes: 2, cycles: 6},
+		{mode: IndirectYIndexed, opcode: 0x71, bytes: 2, cycles: 5},
 	},
 	AND: {
-		{mode: Immediate, opcode: 0x29, bytes: 2},
-		{mode: Zeropage, opcode: 0x25, bytes: 2},
-		{mode: ZeropageXIndexed, opcode: 0x35, bytes: 2},
-		{mode: Absolute, opcode: 0x2d, bytes: 3},
-		{mode: AbsoluteXIndex, opcode: 0x3d, bytes: 3},
-		{mode: AbsoluteYIndex, opcode: 0x39, bytes: 3},
-		{mode: XIndexedIndirect, opcode: 0x21, bytes: 2},
-		{mode: IndirectYIndexed, opcode: 0x31, bytes: 2},
+		{mode: Immediate, opcode: 0x29, bytes: 2, cycles: 2},
+		{mode: Zeropage, opcode: 0x25, bytes: 2, cycles: 3},
+		{mode: ZeropageXIndexed, opcode: 0x35, bytes: 2, cycles: 4},
+		{mode: Absolute, opcode: 0x2d, bytes: 3, cycles: 4},
+		{mode: AbsoluteXIndex, opcode: 0x3d, bytes: 3, cycles: 4},
+		{mode: AbsoluteYIndex, opcode: 0x39, bytes: 3, cycles: 4},
+		{mode: XIndexedIndirect, opcode: 0x21, bytes: 2, cycles: 6},
+		{mode: IndirectYIndexed, opcode: 0x31, bytes: 2, cycles: 5},
+	},
+	ASL: {
+		{mode: Accumulator, opcode: 0x0a, bytes: 1, cycles: 2},
+		{mode: Zeropage, opcode: 0x06, bytes: 2, cycles: 5},
+		{mode: ZeropageXIndexed, opcode: 0x16, bytes: 2, cycles: 6},
+		{mode: Absolute, opcode: 0x0e, bytes: 3, cycles: 6},
+		{mode: AbsoluteXIndex, opcode: 0x1e, bytes: 3, cycles: 7},
+	},
+	BCC: {
+		{mode: Relative, opcode: 0x90, bytes: 2, cycles: 2},
+	},
+	BCS: {
+		{mode: Relative, opcode: 0xb0, bytes: 2, cycles: 2},
+	},
+	BEQ: {
+		{mode: Relative, opcode: 0xf0, bytes: 2, cycles: 2},
+	},
+	BIT: {
+		{mode: Zeropage, opcode: 0x24, bytes: 2, cycles: 3},
+		{mode: Absolute, opcode: 0x2c, bytes: 3, cycles: 4},
+	},
+	BMI: {
+		{mode: Relative, opcode: 0x30, bytes: 2, cycles: 2},
+	},
+	BNE: {
+		{mode: Relative, opcode: 0xd0, bytes: 2, cycles: 2},
+	},
+	BPL: {
+		{mode: Relative, opcode: 0x10, bytes: 2, cycles: 2},
+	},
+	BRK: {
+		{mode: Implied, opcode: 0x00, bytes: 1, cycles: 7},
+	},
+	BVC: {
+		{mode: Relative, opcode: 0x50, bytes: 2, cycles: 2},
+	},
+	BVS: {
+		{mode: Relative, opcode: 0x70, bytes: 2, cycles: 2},
+	},
+	CLC: {
+		{mode: Implied, opcode: 0x18, bytes: 1, cycles: 2},
+	},
+	CLD: {
+		{mode: Implied, opcode: 0xd8, bytes: 1, cycles: 2},
+	},
+	CLI: {
+		{mode: Implied, opcode: 0x58, bytes: 1, cycles: 2},
+	},
+	CLV: {
+		{mode: Implied, opcode: 0xb8, bytes: 1, cycles: 2},
+	},
+	CMP: {
+		{mode: Immediate, opcode: 0xc9, bytes: 2, cycles: 2},
+		{mode: Zeropage, opcode: 0xc5, bytes: 2, cycles: 3},
+		{mode: ZeropageXIndexed, opcode: 0xd5, bytes: 2, cycles: 4},
+		{mode: Absolute, opcode: 0xcd, bytes: 3, cycles: 4},
+		{mode: AbsoluteXIndex, opcode: 0xdd, bytes: 3, cycles: 4},
+		{mode: AbsoluteYIndex, opcode: 0xd9, bytes: 3, cycles: 4},
+		{mode: XIndexedIndirect, opcode: 0xc1, bytes: 2, cycles: 6},
+		{mode: IndirectYIndexed, opcode: 0xd1, bytes: 2, cycles: 5},
+	},
+	CPX: {
+		{mode: Immediate, opcode: 0xe0, bytes: 2, cycles: 2},
+		{mode: Zeropage, opcode: 0xe4, bytes: 2, cycles: 3},
+		{mode: Absolute, opcode: 0xec, bytes: 3, cycles: 4},
+	},
+	CPY: {
+		{mode: Immediate, opcode: 0xc0, bytes: 2, cycles: 2},
+		{mode: Zeropage, opcode: 0xc4, bytes: 2, cycles: 3},
+		{mode: Absolute, opcode: 0xcc, bytes: 3, cycles: 4},
+	},
+	DEC: {
+		{mode: Zeropage, opcode: 0xc6, bytes: 2, cycles: 5},
+		{mode: ZeropageXIndexed, opcode: 0xd6, bytes: 2, cycles: 6},
+		{mode: Absolute, opcode: 0xce, bytes: 3, cycles: 6},
+		{mode: AbsoluteXIndex, opcode: 0xde, bytes: 3, cycles: 7},
+	},
+	DEX: {
+		{mode: Implied, opcode: 0xca, bytes: 1, cycles: 2},
+	},
+	DEY: {
+		{mode: Implied, opcode: 0x88, bytes: 1, cycles: 2},
+	},
+	EOR: {
+		{mode: Immediate, opcode: 0x49, bytes: 2, cycles: 2},
+		{mode: Zeropage, opcode: 0x45, bytes: 2, cycles: 3},
+		{mode: ZeropageXIndexed, opcode: 0x55, bytes: 2, cycles: 4},
+		{mode: Absolute, opcode: 0x4d, bytes: 3, cycles: 4},
+		{mode: AbsoluteXIndex, opcode: 0x5d, bytes: 3, cycles: 4},
+		{mode: AbsoluteYIndex, opcode: 0x59, bytes: 3, cycles: 4},
+		{mode: XIndexedIndirect, opcode: 0x41, bytes: 2, cycles: 6},
+		{mode: IndirectYIndexed, opcode: 0x51, bytes: 2, cycles: 5},
+	},
+	INC: {
+		{mode: Zeropage, opcode: 0xe6, bytes: 2, cycles: 5},
+		{mode: ZeropageXIndexed, opcode: 0xf6, bytes: 2, cycles: 6},
+		{mode: Absolute, opcode: 0xee, bytes: 3, cycles: 6},
+		{mode: AbsoluteXIndex, opcode: 0xfe, bytes: 3, cycles: 7},
+	},
+	INX: {
+		{mode: Implied, opcode: 0xe8, bytes: 1, cycles: 2},
+	},
+	INY: {
+		{mode: Implied, opcode: 0xc8, bytes: 1, cycles: 2},
+	},
+	JMP: {
+		{mode: Absolute, opcode: 0x4c, bytes: 3, cycles: 3},
+		{mode: Indirect, opcode: 0x6c, bytes: 3, cycles: 5},
+	},
+	JSR: {
+		{mode: Absolute, opcode: 0x20, bytes: 3, cycles: 6},
 	},
 	LDA: {
-		{mode: Immediate, opcode: 0xa9, bytes: 2},
-		{mode: Zeropage, opcode: 0xa5, bytes: 2},
-		{mode: ZeropageXIndexed, opcode: 0xb5, bytes: 2},
-		{mode: Absolute, opcode: 0xad, bytes: 3},
-		{mode: AbsoluteXIndex, opcode: 0xbd, bytes: 3},
-		{mode: AbsoluteYIndex, opcode: 0xb9, bytes: 3},
-		{mode: XIndexedIndirect, opcode: 0xa1, bytes: 2},
-		{mode: IndirectYIndexed, opcode: 0xb1, bytes: 2},
+		{mode: Immediate, opcode: 0xa9, bytes: 2, cycles: 2},
+		{mode: Zeropage, opcode: 0xa5, bytes: 2, cycles: 3},
+		{mode: ZeropageXIndexed, opcode: 0xb5, bytes: 2, cycles: 4},
+		{mode: Absolute, opcode: 0xad, bytes: 3, cycles: 4},
+		{mode: AbsoluteXIndex, opcode: 0xbd, bytes: 3, cycles: 4},
+		{mode: AbsoluteYIndex, opcode: 0xb9, bytes: 3, cycles: 4},
+		{mode: XIndexedIndirect, opcode: 0xa1, bytes: 2, cycles: 6},
+		{mode: IndirectYIndexed, opcode: 0xb1, bytes: 2, cycles: 5},
 	},
-	STA: {
-		{mode: Zeropage, opcode: 0x85, bytes: 2},
-		{mode: ZeropageXIndexed, opcode: 0x95, bytes: 2},
-		{mode: Absolute, opcode: 0x8d, bytes: 3},
-		{mode: AbsoluteXIndex, opcode: 0x9d, bytes: 3},
-		{mode: AbsoluteYIndex, opcode: 0x99, bytes: 3},
-		{mode: XIndexedIndirect, opcode: 0x81, bytes: 2},
-		{mode: IndirectYIndexed, opcode: 0x91, bytes: 2},
+	LDX: {
+		{mode: Immediate, opcode: 0xa2, bytes: 2, cycles: 2},
+		{mode: Zeropage, opcode: 0xa6, bytes: 2, cycles: 3},
+		{mode: ZeropageYIndexed, opcode: 0xb6, bytes: 2, cycles: 4},
+		{mode: Absolute, opcode: 0xae, bytes: 3, cycles: 4},
+		{mode: AbsoluteYIndex, opcode: 0xbe, bytes: 3, cycles: 4},
+	},
+	LDY: {
+		{mode: Immediate, opcode: 0xa0, bytes: 2, cycles: 2},
+		{mode: Zeropage, opcode: 0xa4, bytes: 2, cycles: 3},
+		{mode: ZeropageXIndexed, opcode: 0xb4, bytes: 2, cycles: 4},
+		{mode: Absolute, opcode: 0xac, bytes: 3, cycles: 4},
+		{mode: AbsoluteXIndex, opcode: 0xbc, bytes: 3, cycles: 4},
+	},
+	LSR: {
+		{mode: Accumulator, opcode: 0x4a, bytes: 1, cycles: 2},
+		{mode: Zeropage, opcode: 0x46, bytes: 2, cycles: 5},
+		{mode: ZeropageXIndexed, opcode: 0x56, bytes: 2, cycles: 6},
+		{mode: Absolute, opcode: 0x4e, bytes: 3, cycles: 6},
+		{mode: AbsoluteXIndex, opcode: 0x5e, bytes: 3, cycles: 7},
+	},
+	NOP: {
+		{mode: Implied, opcode: 0xea, bytes: 1, cycles: 2},
+	},
+	ORA: {
+		{mode: Immediate, opcode: 0x09, bytes: 2, cycles: 2},
+		{mode: Zeropage, opcode: 0x05, bytes: 2, cycles: 3},
+		{mode: ZeropageXIndexed, opcode: 0x15, bytes: 2, cycles: 4},
+		{mode: Absolute, opcode: 0x0d, bytes: 3, cycles: 4},
+		{mode: AbsoluteXIndex, opcode: 0x1d, bytes: 3, cycles: 4},
+		{mode: AbsoluteYIndex, opcode: 0x19, bytes: 3, cycles: 4},
+		{mode: XIndexedIndirect, opcode: 0x01, bytes: 2, cycles: 6},
+		{mode: IndirectYIndexed, opcode: 0x11, bytes: 2, cycles: 5},
+	},
+	PHA: {
+		{mode: Implied, opcode: 0x48, bytes: 1, cycles: 3},
+	},
+	PHP: {
+		{mode: Implied, opcode: 0x08, bytes: 1, cycles: 3},
+	},
+	PLA: {
+		{mode: Implied, opcode: 0x68, bytes: 1, cycles: 4},
+	},
+	PLP: {
+		{mode: Implied, opcode: 0x28, bytes: 1, cycles: 4},
+	},
+	ROL: {
+		{mode: Accumulator, opcode: 0x2a, bytes: 1, cycles: 2},
+		{mode: Zeropage, opcode: 0x26, bytes: 2, cycles: 5},
+		{mode: ZeropageXIndexed, opcode: 0x36, bytes: 2, cycles: 6},
+		{mode: Absolute, opcode: 0x2e, bytes: 3, cycles: 6},
+		{mode: AbsoluteXIndex, opcode: 0x3e, bytes: 3, cycles: 7},
+	},
+	ROR: {
+		{mode: Accumulator, opcode: 0x6a, bytes: 1, cycles: 2},
+		{mode: Zeropage, opcode: 0x66, bytes: 2, cycles: 5},
+		{mode: ZeropageXIndexed, opcode: 0x76, bytes: 2, cycles: 6},
+		{mode: Absolute, opcode: 0x6e, bytes: 3, cycles: 6},
+		{mode: AbsoluteXIndex, opcode: 0x7e, bytes: 3, cycles: 7},
+	},
+	RTI: {
+		{mode: Implied, opcode: 0x40, bytes: 1, cycles: 6},
 	},
 	RTS: {
-		{mode: Implied, opcode: 0x60, bytes: 1},
+		{mode: Implied, opcode: 0x60, bytes: 1, cycles: 6},
+	},
+	SBC: {
+		{mode: Immediate, opcode: 0xe9, bytes: 2, cycles: 2},
+		{mode: Zeropage, opcode: 0xe5, bytes: 2, cycles: 3},
+		{mode: ZeropageXIndexed, opcode: 0xf5, bytes: 2, cycles: 4},
+		{mode: Absolute, opcode: 0xed, bytes: 3, cycles: 4},
+		{mode: AbsoluteXIndex, opcode: 0xfd, bytes: 3, cycles: 4},
+		{mode: AbsoluteYIndex, opcode: 0xf9, bytes: 3, cycles: 4},
+		{mode: XIndexedIndirect, opcode: 0xe1, bytes: 2, cycles: 6},
+		{mode: IndirectYIndexed, opcode: 0xf1, bytes: 2, cycles: 5},
+	},
+	SEC: {
+		{mode: Implied, opcode: 0x38, bytes: 1, cycles: 2},
+	},
+	SED: {
+		{mode: Implied, opcode: 0xf8, bytes: 1, cycles: 2},
+	},
+	SEI: {
+		{mode: Implied, opcode: 0x78, bytes: 1, cycles: 2},
+	},
+	STA: {
+		{mode: Zeropage, opcode: 0x85, bytes: 2, cycles: 3},
+		{mode: ZeropageXIndexed, opcode: 0x95, bytes: 2, cycles: 4},
+		{mode: Absolute, opcode: 0x8d, bytes: 3, cycles: 4},
+		{mode: AbsoluteXIndex, opcode: 0x9d, bytes: 3, cycles: 5},
+		{mode: AbsoluteYIndex, opcode: 0x99, bytes: 3, cycles: 5},
+		{mode: XIndexedIndirect, opcode: 0x81, bytes: 2, cycles: 6},
+		{mode: IndirectYIndexed, opcode: 0x91, bytes: 2, cycles: 6},
+	},
+	STX: {
+		{mode: Zeropage, opcode: 0x86, bytes: 2, cycles: 3},
+		{mode: ZeropageYIndexed, opcode: 0x96, bytes: 2, cycles: 4},
+		{mode: Absolute, opcode: 0x8e, bytes: 3, cycles: 4},
+	},
+	STY: {
+		{mode: Zeropage, opcode: 0x84, bytes: 2, cycles: 3},
+		{mode: ZeropageXIndexed, opcode: 0x94, bytes: 2, cycles: 4},
+		{mode: Absolute, opcode: 0x8c, bytes: 3, cycles: 4},
+	},
+	TAX: {
+		{mode: Implied, opcode: 0xaa, bytes: 1, cycles: 2},
+	},
+	TAY: {
+		{mode: Implied, opcode: 0xa8, bytes: 1, cycles: 2},
+	},
+	TSX: {
+		{mode: Implied, opcode: 0xba, bytes: 1, cycles: 2},
+	},
+	TXA: {
+		{mode: Implied, opcode: 0x8a, bytes: 1, cycles: 2},
+	},
+	TXS: {
+		{mode: Implied, opcode: 0x9a, bytes: 1, cycles: 2},
+	},
+	TYA: {
+		{mode: Implied, opcode: 0x98, bytes: 1, cycles: 2},
 	},
 }
 
@@ -229,33 +455,6 @@ func instructionEntry(i Instruction, m AddressingMode) (OpcodeForm, error) {
 	return OpcodeForm{}, fmt.Errorf("invalid addressing mode for %s", InstructionStrings[i])
 }
 
-func maxSize(forms []OpcodeForm) uint8 {
-	max := uint8(0)
-	for _, form := range forms {
-		if form.bytes > max {
-			max = form.bytes
-		}
-	}
-	return max
-}
-
-func instructionMax(i Instruction) (uint8, error) {
-	forms, ok := InstructionSet[i]
-	if !ok {
-		return 0, fmt.Errorf("can't find instruction #%d in table", i)
-	}
-	return maxSize(forms), nil
-}
-
-type pseudoOpEntry struct {
-	fn func(a *assembler, line buf.Buffer) error
-}
-
-var pseudoOps = map[string]pseudoOpEntry{
-	".ORG":  {fn: parseOrg},
-	".BYTE": {fn: parseOrg},
-}
-
 type binaryChunk struct {
 	addr int
 	mem  []uint8
@@ -272,34 +471,47 @@ func (c binaryChunk) String() string {
 	return fmt.Sprintf("%x: [%s]", c.addr, strings.Join(b, ", "))
 }
 
+// nodeChunk returns the machine code held by a node, for the nodes that emit
+// anything.
+func nodeChunk(n Node) (binaryChunk, bool) {
+	switch n := n.(type) {
+	case *InstructionNode:
+		return n.inst.chunk, true
+	case *PseudoNode:
+		return n.Pseudo.chunk, true
+	}
+	return binaryChunk{}, false
+}
+
 type Operands struct {
 	mode AddressingMode
 	e    *expr.Node
 	imm  bool
-	abs  bool
+	abs  bool // Width forced to the absolute form
+	zp   bool // Width forced to the zeropage form
 }
 
 // ----- New Node style
 type Node interface {
-	Pos() int
+	Pos() Position
 	node()
 }
 
 type LabelNode struct {
 	Name     string
-	position int
+	position Position
 }
 
-func (n *LabelNode) Pos() int { return n.position }
-func (n *LabelNode) node()    {}
+func (n *LabelNode) Pos() Position { return n.position }
+func (n *LabelNode) node()         {}
 
 type InstructionNode struct {
 	inst     *inst
-	position int
+	position Position
 }
 
-func (n *InstructionNode) Pos() int { return n.position }
-func (n *InstructionNode) node()    {}
+func (n *InstructionNode) Pos() Position { return n.position }
+func (n *InstructionNode) node()         {}
 
 type PseudoOpKind int
 
@@ -307,26 +519,83 @@ const (
 	PseudoOrg PseudoOpKind = iota
 	PseudoByte
 	PseudoEqu
+	PseudoWord
+	PseudoDword
+	PseudoDbyt
+	PseudoText
+	PseudoFill
+	PseudoRes
+	PseudoInclude
+	PseudoIncbin
+	PseudoIncprg
+	PseudoMacro
+	PseudoEndm
+	PseudoIf
+	PseudoIfdef
+	PseudoIfndef
+	PseudoElseif
+	PseudoElse
+	PseudoEndif
+	PseudoRepeat
+	PseudoFor
+	PseudoEndr
 )
 
 var PseudoOpMap = map[string]PseudoOpKind{
-	".ORG":  PseudoOrg,
-	".BYTE": PseudoByte,
-	".EQU":  PseudoEqu,
+	".ORG":     PseudoOrg,
+	".BYTE":    PseudoByte,
+	".EQU":     PseudoEqu,
+	".WORD":    PseudoWord,
+	".DWORD":   PseudoDword,
+	".DBYT":    PseudoDbyt,
+	".TEXT":    PseudoText,
+	".FILL":    PseudoFill,
+	".RES":     PseudoRes,
+	".INCLUDE": PseudoInclude,
+	".INCBIN":  PseudoIncbin,
+	".INCPRG":  PseudoIncprg,
+	".MACRO":   PseudoMacro,
+	".ENDM":    PseudoEndm,
+	".IF":      PseudoIf,
+	".IFDEF":   PseudoIfdef,
+	".IFNDEF":  PseudoIfndef,
+	".ELSEIF":  PseudoElseif,
+	".ELSE":    PseudoElse,
+	".ENDIF":   PseudoEndif,
+	".REPEAT":  PseudoRepeat,
+	".FOR":     PseudoFor,
+	".ENDR":    PseudoEndr,
 }
 
+// PseudoOp is a directive with its arguments. Directives that emit data hold
+// their size and bytes in chunk the same way as an inst.
 type PseudoOp struct {
-	Kind PseudoOpKind
-	Args []*expr.Node
+	Kind  PseudoOpKind
+	Args  []*expr.Node
+	file  []uint8 // Contents of the file named by .INCBIN or .INCPRG
+	size  int
+	chunk binaryChunk
 }
 
 type PseudoNode struct {
 	Pseudo   *PseudoOp
-	position int
+	position Position
 }
 
-func (n *PseudoNode) Pos() int { return n.position }
-func (n *PseudoNode) node()    {}
+func (n *PseudoNode) Pos() Position { return n.position }
+func (n *PseudoNode) node()         {}
+
+// ConstNode assigns the value of an expression to one or more names, from
+// either NAME = value or NAME .EQU value. Labels on the lines leading up to
+// the assignment get the same value.
+type ConstNode struct {
+	Names    []string
+	Expr     *expr.Node
+	position Position
+}
+
+func (n *ConstNode) Pos() Position { return n.position }
+func (n *ConstNode) node()         {}
 
 // ----- End Node style
 
@@ -339,6 +608,8 @@ type inst struct {
 	labels   []string
 	op       Instruction
 	operands Operands
+	mode     AddressingMode // Mode picked for operands during address assignment
+	long     bool           // Branch rewritten as an inverted branch over a JMP
 	size     uint8
 	chunk    binaryChunk
 }
@@ -346,34 +617,204 @@ type inst struct {
 type program []Node
 
 type assembler struct {
-	origin     int
-	currLabel  []string // Needs to be copied when assigned to inst.labels
-	prg        program
-	sym        map[string]int
-	constants  map[string]int
-	exprParser expr.Parser
-	line       int
+	origin       int
+	longBranches bool     // Rewrite out of range branches instead of failing
+	currLabel    []string // Needs to be copied when assigned to inst.labels
+	prg          program
+	sym          map[string]int // Values of all labels and constants
+	constants    map[string]int
+	defs         map[string]Position // Where each symbol was first defined
+	defines      map[string]int      // Symbols predefined on the command line
+	includeDirs  []string            // Searched for included files
+	includes     []string            // Absolute paths of the files being parsed, outermost first
+	exprParser   expr.Parser
+	file         string
+	line         int
+	lines        []*sourceLine // Every line parsed, for the listing
+	macros       map[string]*macro
+	defining     *macro            // Macro whose body is being read
+	expansion    *Expansion        // Macro call being expanded
+	locals       map[string]string // Names for labels local to the expansion
+	expansions   int               // Count of expansions, to make local names unique
+	conds        []conditional     // Open .IF blocks, innermost last
+	known        map[string]int    // Values known while parsing, for conditions
+	scope        string            // Last global label, which local labels belong to
+	anonBackward int               // Count of - labels so far
+	anonForward  int               // Count of + labels so far
+	repeating    *loop             // Loop whose body is being read
+	counters     map[string]int    // Loop counters in the iteration being parsed
+	sizes        map[string]int    // Size of the instruction or data at each label
+}
+
+// addNode appends a node to the program, and to the nodes that came from the
+// line being parsed.
+func (a *assembler) addNode(n Node) {
+	a.prg = append(a.prg, n)
+	if len(a.lines) > 0 {
+		cur := a.lines[len(a.lines)-1]
+		cur.nodes = append(cur.nodes, n)
+	}
+}
+
+// position returns the location in the source of the text held in b, which
+// must be part of the line currently being parsed.
+func (a *assembler) position(b buf.Buffer) Position {
+	return Position{File: a.file, Line: a.line, Col: b.Offset() + 1, Expansion: a.expansion}
+}
+
+// rename returns the name a symbol is known by at the current point in the
+// source. Labels local to a macro expansion or loop iteration get the name
+// for that copy, local labels get the global label they belong to added in
+// front, and anonymous label references are turned into the name of the
+// label they refer to. Anything else is unchanged.
+func (a *assembler) rename(name string) string {
+	if local, found := a.locals[name]; found {
+		return local
+	}
+	switch {
+	case isLocal(name):
+		return a.scope + name
+	case strings.Trim(name, "-") == "":
+		return fmt.Sprintf("-@%d", a.anonBackward-len(name)+1)
+	case strings.Trim(name, "+") == "":
+		return fmt.Sprintf("+@%d", a.anonForward+len(name))
+	}
+	return name
 }
 
 func (a *assembler) parseLine(line buf.Buffer) error {
+	if a.defining != nil {
+		return a.recordMacroLine(line)
+	}
+	if a.repeating != nil {
+		return a.recordLoopLine(line)
+	}
+	if found, err := a.parseConditional(line); found || err != nil {
+		return err
+	}
+	if !a.assembling() {
+		return nil
+	}
 	remain := line
 	if !remain.StartsWith(buf.Whitespace) {
-		remain = a.parseLabel(remain)
-		if remain.StartsWith(buf.Char('=')) {
-			return a.parseConst(remain.Advance(1))
+		var err error
+		remain, err = a.parseLabel(remain)
+		if err != nil {
+			return err
+		}
+		afterSpace := remain.Advance(remain.Scan(buf.Whitespace))
+		if afterSpace.StartsWith(buf.Char('=')) {
+			return a.parseConst(afterSpace.Trunc(1), afterSpace.Advance(1))
 		}
 	}
 	return a.parseOperation(remain)
 }
 
-func (a *assembler) parseLabel(line buf.Buffer) buf.Buffer {
-	label, remain := line.TakeWhile(buf.Letter)
-	labelNode := LabelNode{Name: label.String(), position: a.line}
-	a.prg = append(a.prg, &labelNode)
+// takeSymbol takes a symbol name from the start of b. Names are identifiers,
+// with an @ or . in front for labels local to the last global label.
+func takeSymbol(b buf.Buffer) (name buf.Buffer, remain buf.Buffer) {
+	prefix := 0
+	if b.StartsWith(buf.Char('@')) || b.StartsWith(buf.Char('.')) {
+		prefix = 1
+	}
+	ident, remain := b.Advance(prefix).TakeIdentifier()
+	if ident.IsEmpty() {
+		return b.Trunc(0), b
+	}
+	return b.Trunc(prefix + len(ident.String())), remain
+}
+
+// takeLabel takes the label from the start of a line. A directive in the
+// first column isn't a label, even though it looks like a local one.
+func takeLabel(line buf.Buffer) (label buf.Buffer, remain buf.Buffer) {
+	label, remain = takeSymbol(line)
+	if _, found := PseudoOpMap[strings.ToUpper(label.String())]; found {
+		return line.Trunc(0), line
+	}
+	return label, remain
+}
+
+// isLocal returns true for names of labels local to the last global label.
+func isLocal(name string) bool {
+	return strings.HasPrefix(name, "@") || strings.HasPrefix(name, ".")
+}
+
+func (a *assembler) parseLabel(line buf.Buffer) (buf.Buffer, error) {
+	if line.StartsWith(buf.Char('+')) || line.StartsWith(buf.Char('-')) {
+		return a.parseAnonymousLabel(line)
+	}
+	label, remain := takeLabel(line)
+	if !label.IsEmpty() {
+		if err := a.define(label); err != nil {
+			return remain, err
+		}
+		name := a.rename(label.String())
+		labelNode := LabelNode{Name: name, position: a.position(label)}
+		a.addNode(&labelNode)
+		a.currLabel = append(a.currLabel, name)
+		if !isLocal(label.String()) {
+			a.scope = name
+		}
+	}
 	if remain.StartsWith(buf.Char(':')) {
 		remain = remain.Advance(1)
 	}
-	return remain
+	return remain, nil
+}
+
+// parseAnonymousLabel handles a + or - in the first column, which defines an
+// anonymous label. Operands refer to them with runs of the same sign, - for
+// the closest one before, -- for the one before that, + for the next one
+// after and so on.
+func (a *assembler) parseAnonymousLabel(line buf.Buffer) (buf.Buffer, error) {
+	sign, remain := line.Trunc(1), line.Advance(1)
+	if !remain.IsEmpty() && !remain.StartsWith(buf.Whitespace) && !remain.StartsWith(buf.Char(':')) {
+		return remain, errorfAt(line.Trunc(line.Scan(buf.Word)), "anonymous labels are a single + or -")
+	}
+	var name string
+	if sign.String() == "-" {
+		a.anonBackward++
+		name = fmt.Sprintf("-@%d", a.anonBackward)
+	} else {
+		a.anonForward++
+		name = fmt.Sprintf("+@%d", a.anonForward)
+	}
+	labelNode := LabelNode{Name: name, position: a.position(sign)}
+	a.addNode(&labelNode)
+	if remain.StartsWith(buf.Char(':')) {
+		remain = remain.Advance(1)
+	}
+	return remain, nil
+}
+
+// predefine adds a constant from outside the source, like a -D option on the
+// command line.
+func (a *assembler) predefine(name string, val int) {
+	if a.defines == nil {
+		a.defines = map[string]int{}
+	}
+	if a.defs == nil {
+		a.defs = map[string]Position{}
+	}
+	if a.known == nil {
+		a.known = map[string]int{}
+	}
+	a.defines[name] = val
+	a.known[name] = val
+	a.defs[name] = Position{File: "command line"}
+}
+
+// define records where a symbol is defined, failing if it already has a
+// definition.
+func (a *assembler) define(name buf.Buffer) error {
+	if a.defs == nil {
+		a.defs = map[string]Position{}
+	}
+	if pos, found := a.defs[a.rename(name.String())]; found {
+		return errorfAt(name, "%s redefined, first defined at %s", name, pos)
+	}
+	a.defs[a.rename(name.String())] = a.position(name)
+	return nil
 }
 
 func (a *assembler) parseOperation(line buf.Buffer) error {
@@ -382,97 +823,236 @@ func (a *assembler) parseOperation(line buf.Buffer) error {
 		return nil
 	}
 
+	// * = addr sets the program counter, the same as .ORG addr
+	if remain.StartsWith(buf.Char('*')) {
+		value := remain.Advance(1)
+		value = value.Advance(value.Scan(buf.Whitespace))
+		if value.StartsWith(buf.Char('=')) {
+			a.currLabel = nil
+			return a.parsePseudo(PseudoOrg, remain.Trunc(1), value.Advance(1))
+		}
+	}
+
 	op, remain := remain.TakeWhile(buf.Word)
 	if pseudoKind, found := PseudoOpMap[strings.ToUpper(op.String())]; found {
-		return a.parsePseudo(pseudoKind, remain)
+		if pseudoKind == PseudoEqu {
+			return a.parseConst(op, remain)
+		}
+		a.currLabel = nil
+		switch pseudoKind {
+		case PseudoInclude:
+			return a.parseInclude(op, remain)
+		case PseudoIncbin, PseudoIncprg:
+			return a.parseIncbin(pseudoKind, op, remain)
+		case PseudoMacro:
+			return a.parseMacro(op, remain)
+		case PseudoEndm:
+			return errorfAt(op, ".ENDM without .MACRO")
+		case PseudoRepeat, PseudoFor:
+			return a.startLoop(pseudoKind, op, remain)
+		case PseudoEndr:
+			return errorfAt(op, ".ENDR without .REPEAT or .FOR")
+		}
+		return a.parsePseudo(pseudoKind, op, remain)
+	}
+	a.currLabel = nil
+	if m, found := a.macros[op.String()]; found {
+		return a.expandMacro(m, op, remain)
 	}
-	return a.parseOpcode(op.String(), remain)
+	return a.parseOpcode(op, remain)
 }
 
-func (a *assembler) parsePseudo(pseudo PseudoOpKind, line buf.Buffer) error {
-	pseudoOp := PseudoOp{Kind: pseudo}
+func (a *assembler) parsePseudo(pseudo PseudoOpKind, op buf.Buffer, line buf.Buffer) error {
+	args, err := a.parseArgs(line)
+	if err != nil {
+		return err
+	}
+	pseudoOp := PseudoOp{Kind: pseudo, Args: args}
+	pseudoNode := PseudoNode{Pseudo: &pseudoOp, position: a.position(op)}
+	a.addNode(&pseudoNode)
+	return nil
+}
+
+// parseArgs parses a comma separated list of expressions, up to the end of
+// the line or a comment.
+func (a *assembler) parseArgs(line buf.Buffer) ([]*expr.Node, error) {
+	args := []*expr.Node{}
 	remain := line.Advance(line.Scan(buf.Whitespace))
-	for !remain.IsEmpty() {
+	for !endOfArgs(remain) {
 		expr, newRemain, err := a.exprParser.Parse(remain)
 		if err != nil {
-			return err
+			return nil, errorAt(remain, err)
+		}
+		args = append(args, expr)
+		remain = newRemain.Advance(newRemain.Scan(buf.Whitespace))
+		if endOfArgs(remain) {
+			break
 		}
-		pseudoOp.Args = append(pseudoOp.Args, expr)
-		remain = newRemain
-		if remain.StartsWith(buf.Char(',')) {
-			remain = remain.Advance(1)
+		if !remain.StartsWith(buf.Char(',')) {
+			return nil, errorfAt(remain, "unexpected text %v", remain.String())
+		}
+		comma := remain.Trunc(1)
+		remain = remain.Advance(1)
+		remain = remain.Advance(remain.Scan(buf.Whitespace))
+		if endOfArgs(remain) || remain.StartsWith(buf.Char(',')) {
+			return nil, errorfAt(comma, "missing argument after ,")
 		}
 	}
-	pseudoNode := PseudoNode{Pseudo: &pseudoOp, position: a.line}
-	a.prg = append(a.prg, &pseudoNode)
-	return nil
+	return args, nil
+}
+
+// endOfArgs is true once only a comment or nothing at all is left on the line.
+func endOfArgs(line buf.Buffer) bool {
+	return line.IsEmpty() || line.StartsWith(buf.Char(';'))
 }
 
-func (a *assembler) parseOpcode(opcode string, line buf.Buffer) error {
+func (a *assembler) parseOpcode(op buf.Buffer, line buf.Buffer) error {
+	// A .A or .Z suffix on the mnemonic forces the operand width
+	opcode, width, _ := strings.Cut(strings.ToUpper(op.String()), ".")
 	i, err := ToInstruction(opcode)
 	if err != nil {
-		return err
-	}
-	maxBytes, err := instructionMax(i)
-	if err != nil {
-		return err
+		return errorAt(op, err)
 	}
 	operands, remain, err := a.parseOperands(line)
 	if err != nil {
 		return err
 	}
+	switch width {
+	case "":
+	case "A":
+		operands.abs = true
+	case "Z":
+		operands.zp = true
+	default:
+		return errorfAt(op, "unknown width suffix .%s on %s", width, opcode)
+	}
+	// Shifts and rotates on the accumulator can be written with or without A.
+	// Anything else with an operand of A is using a symbol with that name.
+	if _, err := instructionEntry(i, Accumulator); err == nil {
+		if operands.mode == Implied {
+			operands.mode = Accumulator
+		}
+	} else if operands.mode == Accumulator {
+		operands.mode = Absolute
+	}
+	// Branches are written like absolute operands but assemble as an offset
+	if _, err := instructionEntry(i, Relative); err == nil && operands.mode == Absolute {
+		operands.mode = Relative
+	}
+	if operands.abs && operands.zp {
+		return errorfAt(op, "conflicting width overrides on %s", opcode)
+	}
 	remain = remain.Advance(remain.Scan(buf.Whitespace))
-	if !remain.IsEmpty() || remain.StartsWith(buf.Char(';')) {
-		return fmt.Errorf("unexpected text %v", remain.String())
+	if !remain.IsEmpty() && !remain.StartsWith(buf.Char(';')) {
+		return errorfAt(remain, "unexpected text %v", remain.String())
 	}
 	instruction := inst{
 		labels:   append([]string{}, a.currLabel...),
 		op:       i,
 		operands: operands,
-		size:     maxBytes,
 		chunk:    binaryChunk{addr: 0},
 	}
-	instructionNode := InstructionNode{inst: &instruction, position: a.line}
-	a.prg = append(a.prg, &instructionNode)
+	if _, err = a.selectMode(&instruction); err != nil {
+		return errorAt(line.Advance(line.Scan(buf.Whitespace)), err)
+	}
+	instructionNode := InstructionNode{inst: &instruction, position: a.position(op)}
+	a.addNode(&instructionNode)
 	return nil
 }
 
 func (a *assembler) parseOperands(line buf.Buffer) (oper Operands, remain buf.Buffer, err error) {
 	remain = line.Advance(line.Scan(buf.Whitespace))
+	defer func() {
+		if err != nil {
+			err = errorAt(line.Advance(line.Scan(buf.Whitespace)), err)
+		}
+	}()
 	switch {
-	case remain.IsEmpty():
+	case remain.IsEmpty() || remain.StartsWith(buf.Char(';')):
 		oper.mode = Implied
+	case remain.StartsWith(buf.StrFold("A")) && endOfOperand(remain.Advance(1)):
+		// Could also be a symbol named A, parseOpcode sorts out which once
+		// it knows if the instruction has an accumulator form
+		oper.mode = Accumulator
+		oper.e, remain, err = a.exprParser.Parse(remain)
 	case remain.StartsWith(buf.Char('(')):
 		var e buf.Buffer
 		oper.mode, e, remain, err = a.parseIndirect(remain.Advance(1))
 		if err != nil {
 			return
 		}
-		oper.e, _, err = a.exprParser.Parse(e)
+		oper.e, err = a.parseOperand(e)
 	case remain.StartsWith(buf.Char('#')):
 		oper.mode = Immediate
 		oper.imm = true
 		oper.e, remain, err = a.exprParser.Parse(remain.Advance(1))
 	default:
+		// An a: or z: prefix on the operand forces the width
+		switch {
+		case remain.StartsWith(buf.StrFold("a:")):
+			oper.abs = true
+			remain = remain.Advance(2)
+		case remain.StartsWith(buf.StrFold("z:")):
+			oper.zp = true
+			remain = remain.Advance(2)
+		}
 		var e buf.Buffer
 		oper.mode, e, remain, err = a.parseAbsolute(remain)
 		if err != nil {
 			return
 		}
-		oper.e, _, err = a.exprParser.Parse(e)
+		oper.e, err = a.parseOperand(e)
 	}
 	return
 }
 
+// parseOperand parses the expression part of an operand, which has already
+// been split off from the addressing mode, so it all has to be used up.
+func (a *assembler) parseOperand(e buf.Buffer) (*expr.Node, error) {
+	n, remain, err := a.exprParser.Parse(e.Advance(e.Scan(buf.Whitespace)))
+	if err != nil {
+		return nil, err
+	}
+	remain = remain.Advance(remain.Scan(buf.Whitespace))
+	if !remain.IsEmpty() {
+		return nil, fmt.Errorf("unexpected text %v", remain.String())
+	}
+	return n, nil
+}
+
+func endOfOperand(line buf.Buffer) bool {
+	return line.IsEmpty() || line.StartsWith(buf.Whitespace) || line.StartsWith(buf.Char(';'))
+}
+
+// scanOperand returns the index of the first character in line matched by
+// stop that isn't inside parentheses, so function calls like min(a,b) stay
+// in one piece. Returns the length of line if there isn't one.
+func scanOperand(line buf.Buffer, stop func(c byte) bool) int {
+	s := line.String()
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '(':
+			depth++
+		case s[i] == ')' && depth > 0:
+			depth--
+		case depth == 0 && stop(s[i]):
+			return i
+		}
+	}
+	return len(s)
+}
+
 func (a *assembler) parseIndirect(line buf.Buffer) (mode AddressingMode, expr buf.Buffer, remain buf.Buffer, err error) {
-	expr, remain = line.TakeUntil(func(s string) bool { return s[0] == ',' || s[0] == ')' })
+	i := scanOperand(line, func(c byte) bool { return c == ',' || c == ')' })
+	expr, remain = line.Trunc(i), line.Advance(i)
 
-	if remain.StartsWith(buf.Str(",X)")) {
+	if remain.StartsWith(buf.StrFold(",X)")) {
 		mode = XIndexedIndirect
 		remain = remain.Advance(3)
 		return
 	}
-	if remain.StartsWith(buf.Str("),Y")) {
+	if remain.StartsWith(buf.StrFold("),Y")) {
 		mode = IndirectYIndexed
 		remain = remain.Advance(3)
 		return
@@ -482,18 +1062,19 @@ func (a *assembler) parseIndirect(line buf.Buffer) (mode AddressingMode, expr bu
 		remain = remain.Advance(1)
 		return
 	}
-	err = fmt.Errorf("incorrect indirect format: %s", line.String())
+	err = errorfAt(line, "incorrect indirect format: %s", line.String())
 	return
 }
 
 func (a *assembler) parseAbsolute(line buf.Buffer) (mode AddressingMode, expr buf.Buffer, remain buf.Buffer, err error) {
-	expr, remain = line.TakeUntil(func(s string) bool { return s[0] == ',' || buf.Whitespace(s) })
+	i := scanOperand(line, func(c byte) bool { return c == ',' || c == ' ' || c == '\t' })
+	expr, remain = line.Trunc(i), line.Advance(i)
 
 	switch {
-	case remain.StartsWith(buf.Str(",X")):
+	case remain.StartsWith(buf.StrFold(",X")):
 		mode = AbsoluteXIndex
 		remain = remain.Advance(2)
-	case remain.StartsWith(buf.Str(",Y")):
+	case remain.StartsWith(buf.StrFold(",Y")):
 		mode = AbsoluteYIndex
 		remain = remain.Advance(2)
 	default:
@@ -504,35 +1085,80 @@ func (a *assembler) parseAbsolute(line buf.Buffer) (mode AddressingMode, expr bu
 	return
 }
 
-func (a *assembler) parseConst(line buf.Buffer) error {
-	e, _, err := a.exprParser.Parse(line)
-	if err != nil {
-		return fmt.Errorf("parseConst failed to parse expression %w", err)
-	}
-	ok, err := e.Eval(map[string]int{})
-	if !ok || err != nil {
-		return fmt.Errorf("parseConst failed to evaluate expression %w", err)
+// parseConst handles the value side of a constant assignment. The labels
+// waiting for an instruction become constants instead, so their label nodes
+// are swapped for a single ConstNode. The value is worked out along with the
+// labels while assigning addresses.
+func (a *assembler) parseConst(op buf.Buffer, line buf.Buffer) error {
+	if len(a.currLabel) == 0 {
+		return errorfAt(op, "constant assignment without a name")
 	}
-	val, err := e.Value()
+	line = line.Advance(line.Scan(buf.Whitespace))
+	e, remain, err := a.exprParser.Parse(line)
 	if err != nil {
-		return fmt.Errorf("parseConst failed getting Value() %w", err)
+		return errorAt(line, err)
 	}
-	for _, v := range a.currLabel {
-		a.constants[v] = val
+	remain = remain.Advance(remain.Scan(buf.Whitespace))
+	if !remain.IsEmpty() && !remain.StartsWith(buf.Char(';')) {
+		return errorfAt(remain, "unexpected text %v", remain.String())
 	}
-	a.currLabel = []string{}
+	// Constants that only use values already known can be used in the
+	// conditions of later lines
+	if val, err := evaluate(e, a.known); err == nil {
+		if a.known == nil {
+			a.known = map[string]int{}
+		}
+		for _, name := range a.currLabel {
+			a.known[name] = val
+		}
+	}
+	a.dropLabels(a.currLabel)
+	constNode := ConstNode{Names: a.currLabel, Expr: e, position: a.position(line)}
+	a.addNode(&constNode)
+	a.currLabel = nil
 	return nil
 }
 
-func parseOrg(a *assembler, line buf.Buffer) error {
-	e, _, err := a.exprParser.Parse(line.Advance(line.Scan(buf.Whitespace)))
-	if err != nil {
-		return err
+// dropLabels removes the label nodes for names, which are waiting for an
+// instruction at the end of the program, from the program and from the lines
+// they were parsed on. Anonymous labels in between are left alone since they
+// aren't turned into constants.
+func (a *assembler) dropLabels(names []string) {
+	drop := map[string]bool{}
+	for _, name := range names {
+		drop[name] = true
+	}
+	keep := func(nodes []Node, start int) []Node {
+		kept := nodes[:start]
+		for _, n := range nodes[start:] {
+			if l, ok := n.(*LabelNode); !ok || !drop[l.Name] {
+				kept = append(kept, n)
+			}
+		}
+		return kept
 	}
+	a.prg = keep(a.prg, trailingLabels(a.prg))
+	for i := len(a.lines) - 1; i >= 0; i-- {
+		l := a.lines[i]
+		start := trailingLabels(l.nodes)
+		l.nodes = keep(l.nodes, start)
+		if start > 0 {
+			break
+		}
+	}
+}
 
-	e.Eval(a.sym)
-	a.origin, err = e.Value()
-	return err
+// trailingLabels returns the index of the run of label nodes at the end of
+// nodes.
+func trailingLabels(nodes []Node) int {
+	i := len(nodes)
+	for i > 0 {
+		if _, ok := nodes[i-1].(*LabelNode); !ok {
+			break
+		}
+		i--
+	}
+	return i
 }
 
 func (a *assembler) parseFile(filename string) (err error) {
@@ -541,20 +1167,64 @@ func (a *assembler) parseFile(filename string) (err error) {
 		return
 	}
 	defer file.Close()
+	a.file = filename
+	if abs, err := filepath.Abs(filename); err == nil {
+		a.includes = append(a.includes, abs)
+		defer func() { a.includes = a.includes[:len(a.includes)-1] }()
+	}
 	return a.parseReader(file)
 }
 
+// parseReader parses every line of the source, carrying on past lines with
+// errors. If any lines failed the returned error is the Diagnostics for all
+// of them.
 func (a *assembler) parseReader(r io.Reader) (err error) {
 	a.line = 1
+	a.exprParser.Rename = a.rename
+	a.exprParser.Functions = map[string]*expr.Function{
+		"defined": {MinArgs: 1, MaxArgs: 1, Call: a.defined, AtParse: true},
+		"sizeof":  {MinArgs: 1, MaxArgs: 1, Call: a.sizeof},
+	}
+	depth := len(a.conds)
+	var diags Diagnostics
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		err = a.parseLine(buf.NewBuffer(scanner.Text()))
-		if err != nil {
-			return
-		}
+		diags = append(diags, a.parseSourceLine(scanner.Text())...)
 		a.line++
 	}
-	return nil
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if a.defining != nil {
+		err := fmt.Errorf("missing .ENDM for macro %s", a.defining.name)
+		diags = append(diags, diagnosticAt(a.defining.pos, err))
+		a.defining = nil
+	}
+	if a.repeating != nil {
+		diags = append(diags, diagnosticAt(a.repeating.pos, fmt.Errorf("missing .ENDR")))
+		a.repeating = nil
+	}
+	diags = append(diags, a.checkConditionals(depth)...)
+	return diags.err()
+}
+
+// parseSourceLine parses a single line of text at the current position,
+// returning diagnostics for any problems with it.
+func (a *assembler) parseSourceLine(text string) Diagnostics {
+	line := buf.NewBuffer(text)
+	a.lines = append(a.lines, &sourceLine{pos: a.position(line), text: line.String()})
+	err := a.parseLine(line)
+	if err == nil {
+		return nil
+	}
+	// Errors from included files and macro expansions already have their
+	// positions
+	var nested Diagnostics
+	if errors.As(err, &nested) {
+		return nested
+	}
+	start := line.Advance(line.Scan(buf.Whitespace))
+	return Diagnostics{diagnosticAt(a.position(start), err)}
 }
 
 func (a *assembler) dumpAssembler(w io.Writer) {
@@ -562,51 +1232,539 @@ func (a *assembler) dumpAssembler(w io.Writer) {
 	fmt.Fprintf(w, "Starting address: %d\n", a.origin)
 }
 
-func (a *assembler) binaryImage() []uint8 {
-	bytes := []uint8{}
+// zeropageModes maps the absolute addressing modes to their shorter zeropage
+// equivalents.
+var zeropageModes = map[AddressingMode]AddressingMode{
+	Absolute:       Zeropage,
+	AbsoluteXIndex: ZeropageXIndexed,
+	AbsoluteYIndex: ZeropageYIndexed,
+}
+
+// selectMode picks the addressing mode used to assemble an instruction.
+// Operands that could be assembled in either the absolute or zeropage form
+// use zeropage when the value is already known to fit in a byte, unless the
+// width has been forced.
+func (a *assembler) selectMode(in *inst) (AddressingMode, error) {
+	mode := in.operands.mode
+	zpMode, ok := zeropageModes[mode]
+	if !ok {
+		_, err := instructionEntry(in.op, mode)
+		return mode, err
+	}
+	_, absErr := instructionEntry(in.op, mode)
+	_, zpErr := instructionEntry(in.op, zpMode)
+	switch {
+	case in.operands.zp:
+		return zpMode, zpErr
+	case in.operands.abs, zpErr != nil:
+		return mode, absErr
+	case absErr != nil:
+		return zpMode, nil
+	}
+	val, err := evaluate(in.operands.e, a.sym)
+	if err == nil && val >= 0 && val <= 0xff {
+		return zpMode, nil
+	}
+	return mode, nil
+}
+
+// invertedBranch maps each branch to the one that tests the opposite
+// condition, used when rewriting a branch that can't reach its target.
+var invertedBranch = map[Instruction]Instruction{
+	BCC: BCS,
+	BCS: BCC,
+	BEQ: BNE,
+	BNE: BEQ,
+	BMI: BPL,
+	BPL: BMI,
+	BVC: BVS,
+	BVS: BVC,
+}
+
+// longBranchSize is the size of an inverted branch followed by a JMP.
+const longBranchSize = 5
+
+// branchOffset returns the displacement from the instruction following a
+// branch to its target.
+func branchOffset(addr int, target int) int {
+	return target - (addr + 2)
+}
+
+// branchRangeError reports how far outside the signed 8 bit range a branch
+// displacement falls, or nil if it's in range.
+func branchRangeError(offset int) error {
+	switch {
+	case offset > 127:
+		return fmt.Errorf("branch out of range by %d bytes", offset-127)
+	case offset < -128:
+		return fmt.Errorf("branch out of range by %d bytes", -128-offset)
+	}
+	return nil
+}
+
+// sizeInstruction updates the addressing mode and size of an instruction
+// based on the current state of the symbol table. The address of the
+// instruction must already be set in its chunk. Returns true if the size
+// changed.
+func (a *assembler) sizeInstruction(in *inst) (changed bool, err error) {
+	mode, err := a.selectMode(in)
+	if err != nil {
+		return
+	}
+	form, err := instructionEntry(in.op, mode)
+	if err != nil {
+		return
+	}
+	size := form.bytes
+	if mode == Relative && a.longBranches {
+		// Once a branch has been made long it stays long, so that passes
+		// can't flip back and forth between the two sizes
+		if !in.long {
+			target, evalErr := evaluate(in.operands.e, a.sym)
+			in.long = evalErr == nil && branchRangeError(branchOffset(in.chunk.addr, target)) != nil
+		}
+		if in.long {
+			size = longBranchSize
+		}
+	}
+	changed = in.size != size
+	in.mode = mode
+	in.size = size
+	return
+}
+
+// maxPasses limits the number of times addresses are reassigned while
+// waiting for instruction sizes to settle.
+const maxPasses = 16
+
+// resolveAddresses runs assignAddresses until no instruction changes size and
+// no label moves. Forward references are unknown the first time through, so
+// they start out with absolute addressing and shrink to zeropage on a later
+// pass once their values are known.
+func (a *assembler) resolveAddresses() error {
+	a.sym = map[string]int{}
+	a.constants = map[string]int{}
+	a.sizes = map[string]int{}
+	for name, val := range a.defines {
+		a.sym[name] = val
+		a.constants[name] = val
+	}
+	var changed Node
+	for pass := 0; pass < maxPasses; pass++ {
+		var err error
+		changed, err = a.assignAddresses()
+		if err != nil {
+			return err
+		}
+		if changed == nil {
+			return nil
+		}
+	}
+	// Point at the first node still changing on the last pass, which is
+	// usually where the problem starts
+	return diagnosticAt(changed.Pos(), fmt.Errorf("addresses did not settle after %d passes", maxPasses))
+}
+
+// assignAddresses is a single pass over the program. Starting from the origin
+// it sizes every instruction, works out its address and records the value of
+// each label in the symbol table. Returns the first node whose size or value
+// changed since the previous pass, or nil if nothing did.
+func (a *assembler) assignAddresses() (changed Node, err error) {
+	markChanged := func(n Node) {
+		if changed == nil {
+			changed = n
+		}
+	}
+	pc := a.origin
+	emitted := false
+	var pending error
+	unsized := []string{} // Labels waiting for the size of the next node
 	for _, node := range a.prg {
-		// bytes = append(bytes, val.chunk.mem...)
+		a.sym[expr.ProgramCounter] = pc
 		switch n := node.(type) {
+		case *LabelNode:
+			if val, found := a.sym[n.Name]; !found || val != pc {
+				markChanged(n)
+			}
+			a.sym[n.Name] = pc
+			unsized = append(unsized, n.Name)
+		case *ConstNode:
+			val, err := evaluate(n.Expr, a.sym)
+			if err != nil {
+				if pending == nil && isUndefined(err) {
+					if cycle := a.constCycle(n); cycle != nil {
+						err = cycle
+					}
+				}
+				pending = pendingError(pending, n, err)
+				continue
+			}
+			for _, name := range n.Names {
+				if prev, found := a.sym[name]; !found || prev != val {
+					markChanged(n)
+				}
+				a.sym[name] = val
+				a.constants[name] = val
+			}
 		case *InstructionNode:
-			fmt.Printf("Process instruction %v\n", n.inst.op)
+			n.inst.chunk.addr = pc
+			resized, err := a.sizeInstruction(n.inst)
+			if err != nil {
+				return nil, diagnosticAt(n.Pos(), err)
+			}
+			if resized {
+				markChanged(n)
+			}
+			a.setSizes(unsized, int(n.inst.size))
+			unsized = nil
+			pc += int(n.inst.size)
+			emitted = true
+		case *PseudoNode:
+			p := n.Pseudo
+			p.chunk.addr = pc
+			if p.Kind == PseudoOrg {
+				if len(p.Args) != 1 {
+					return nil, diagnosticAt(n.Pos(), fmt.Errorf(".ORG takes a single address"))
+				}
+				addr, err := evaluate(p.Args[0], a.sym)
+				if err != nil {
+					pending = pendingError(pending, n, err)
+					continue
+				}
+				pc = addr
+				if !emitted {
+					a.origin = addr
+				}
+				a.setSizes(unsized, 0)
+				unsized = nil
+				continue
+			}
+			size, err := a.pseudoSize(p)
+			if err != nil {
+				pending = pendingError(pending, n, err)
+			}
+			if size != p.size {
+				markChanged(n)
+			}
+			p.size = size
+			a.setSizes(unsized, size)
+			unsized = nil
+			pc += size
+			emitted = emitted || (size > 0 && p.Kind != PseudoRes)
 		}
+		if pending != nil && !isUndefined(pending) {
+			return nil, pending
+		}
+	}
+	a.setSizes(unsized, 0)
+	// Values that depend on symbols later in the program might be known on
+	// the next pass, so undefined symbols are only an error once nothing is
+	// changing any more
+	if changed == nil && pending != nil {
+		return nil, pending
 	}
-	return bytes
+	return
 }
 
-func writeProgram(startAddr int, bytes []uint8, filename string) (err error) {
-	file, err := os.Create(filename)
+// constCycle checks whether a constant is undefined because it depends on
+// itself, directly or through other constants. The chain of undefined
+// symbols is followed from n, and if it loops back around an error listing
+// the cycle is returned.
+func (a *assembler) constCycle(n *ConstNode) error {
+	exprs := map[string]*expr.Node{}
+	for _, node := range a.prg {
+		if c, ok := node.(*ConstNode); ok {
+			for _, name := range c.Names {
+				exprs[name] = c.Expr
+			}
+		}
+	}
+	chain := []string{n.Names[0]}
+	for {
+		_, err := evaluate(exprs[chain[len(chain)-1]], a.sym)
+		var undef *expr.UndefinedSymbolError
+		if !errors.As(err, &undef) {
+			return nil
+		}
+		if _, ok := exprs[undef.Name]; !ok {
+			return nil
+		}
+		for i, name := range chain {
+			if name == undef.Name {
+				cycle := append(chain[i:], undef.Name)
+				return fmt.Errorf("circular definition: %s", strings.Join(cycle, " -> "))
+			}
+		}
+		chain = append(chain, undef.Name)
+	}
+}
+
+// pendingError keeps the first error seen while assigning addresses, as a
+// diagnostic for the node that caused it.
+func pendingError(pending error, n Node, err error) error {
+	if pending != nil {
+		return pending
+	}
+	return diagnosticAt(n.Pos(), err)
+}
+
+func isUndefined(err error) bool {
+	var undef *expr.UndefinedSymbolError
+	return errors.As(err, &undef)
+}
+
+// generateCode is the second pass over the program. Every operand is
+// evaluated against the symbol table built by assignAddresses and the machine
+// code for each instruction is stored in its chunk. Problems with individual
+// nodes don't stop the pass, they're all returned together as Diagnostics.
+func (a *assembler) generateCode() error {
+	// The program counter is only a symbol while the node using it is being
+	// evaluated, it shouldn't end up in the symbol table
+	defer delete(a.sym, expr.ProgramCounter)
+	var diags Diagnostics
+	for _, node := range a.prg {
+		switch n := node.(type) {
+		case *InstructionNode:
+			a.sym[expr.ProgramCounter] = n.inst.chunk.addr
+			mem, err := a.encode(n.inst)
+			if err != nil {
+				diags = append(diags, diagnosticAt(n.Pos(), err))
+			}
+			n.inst.chunk.mem = mem
+		case *PseudoNode:
+			a.sym[expr.ProgramCounter] = n.Pseudo.chunk.addr
+			mem, err := a.encodePseudo(n.Pseudo)
+			if err != nil {
+				diags = append(diags, diagnosticAt(n.Pos(), err))
+			}
+			n.Pseudo.chunk.mem = mem
+		}
+	}
+	return diags.err()
+}
+
+// dataWidths holds the number of bytes each argument takes up for the
+// directives that emit a list of values.
+var dataWidths = map[PseudoOpKind]int{
+	PseudoByte:  1,
+	PseudoText:  1,
+	PseudoWord:  2,
+	PseudoDbyt:  2,
+	PseudoDword: 4,
+}
+
+// pseudoSize returns the number of bytes a directive adds to the program.
+func (a *assembler) pseudoSize(p *PseudoOp) (int, error) {
+	if width, ok := dataWidths[p.Kind]; ok {
+		size := 0
+		for _, arg := range p.Args {
+			if s, ok := arg.StringValue(); ok {
+				if width != 1 {
+					return 0, fmt.Errorf("strings are only allowed in .BYTE and .TEXT")
+				}
+				size += len(s)
+				continue
+			}
+			size += width
+		}
+		return size, nil
+	}
+	switch p.Kind {
+	case PseudoFill:
+		if len(p.Args) != 2 {
+			return 0, fmt.Errorf(".FILL takes a count and a value")
+		}
+		return evaluateCount(p.Args[0], a.sym)
+	case PseudoRes:
+		if len(p.Args) != 1 {
+			return 0, fmt.Errorf(".RES takes a single count")
+		}
+		return evaluateCount(p.Args[0], a.sym)
+	case PseudoIncbin, PseudoIncprg:
+		start, end, err := a.incbinRange(p)
+		return end - start, err
+	}
+	return 0, nil
+}
+
+func evaluateCount(e *expr.Node, sym map[string]int) (int, error) {
+	count, err := evaluate(e, sym)
 	if err != nil {
-		return fmt.Errorf("create file %v", err)
+		return 0, err
 	}
-	defer file.Close()
+	if count < 0 {
+		return 0, fmt.Errorf("negative count %d", count)
+	}
+	return count, nil
+}
 
-	startBytes := []uint8{uint8(startAddr & 0xff), uint8((startAddr >> 8) & 0xff)}
+// encodePseudo returns the bytes emitted by a directive. Multi byte values
+// are little endian except for .DBYT.
+func (a *assembler) encodePseudo(p *PseudoOp) ([]uint8, error) {
+	switch p.Kind {
+	case PseudoFill:
+		val, err := evaluate(p.Args[1], a.sym)
+		if err != nil {
+			return nil, err
+		}
+		mem, err := encodeData(PseudoByte, val)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Repeat(mem, p.size), nil
+	case PseudoRes:
+		// Only the location counter moves, nothing is written to the
+		// reserved space
+		return nil, nil
+	case PseudoIncbin, PseudoIncprg:
+		start, end, err := a.incbinRange(p)
+		if err != nil {
+			return nil, err
+		}
+		return p.file[start:end], nil
+	}
+	if _, ok := dataWidths[p.Kind]; !ok {
+		return nil, nil
+	}
+	mem := []uint8{}
+	for _, arg := range p.Args {
+		if s, ok := arg.StringValue(); ok {
+			mem = append(mem, []uint8(s)...)
+			continue
+		}
+		val, err := evaluate(arg, a.sym)
+		if err != nil {
+			return nil, err
+		}
+		data, err := encodeData(p.Kind, val)
+		if err != nil {
+			return nil, err
+		}
+		mem = append(mem, data...)
+	}
+	return mem, nil
+}
+
+// encodeData returns a single value in the form used by a data directive,
+// checking that it fits. Negative values are allowed down to the signed
+// minimum for the width.
+func encodeData(kind PseudoOpKind, val int) ([]uint8, error) {
+	width := dataWidths[kind]
+	bits := uint(8 * width)
+	if val < -(1<<(bits-1)) || val >= 1<<bits {
+		return nil, fmt.Errorf("value %d does not fit in %d bits", val, bits)
+	}
+	mem := make([]uint8, width)
+	for i := range mem {
+		mem[i] = uint8(val >> (8 * i))
+	}
+	if kind == PseudoDbyt {
+		mem[0], mem[1] = mem[1], mem[0]
+	}
+	return mem, nil
+}
 
-	_, err = file.Write(startBytes)
+// encode returns the opcode followed by the little endian operand bytes for a
+// single instruction.
+func (a *assembler) encode(in *inst) ([]uint8, error) {
+	form, err := instructionEntry(in.op, in.mode)
 	if err != nil {
-		return fmt.Errorf("error writing bytes %v", err)
+		return nil, err
+	}
+	mem := []uint8{form.opcode}
+	if form.bytes == 1 {
+		return mem, nil
 	}
-	_, err = file.Write(bytes)
+	val, err := evaluate(in.operands.e, a.sym)
 	if err != nil {
-		return fmt.Errorf("error writing bytes %v", err)
+		return nil, err
 	}
-	return nil
+	if in.mode == Relative {
+		return encodeBranch(in, val)
+	}
+	switch form.bytes {
+	case 2:
+		if val < -128 || val > 0xff || (val < 0 && in.mode != Immediate) {
+			return nil, fmt.Errorf("operand %d out of range for %s", val, in.op)
+		}
+		mem = append(mem, uint8(val))
+	case 3:
+		if val < 0 || val > 0xffff {
+			return nil, fmt.Errorf("operand %d out of range for %s", val, in.op)
+		}
+		mem = append(mem, uint8(val&0xff), uint8((val>>8)&0xff))
+	}
+	return mem, nil
 }
 
-func main() {
-	a := assembler{origin: 0xc000}
-	err := a.parseFile(os.Args[1])
+// encodeBranch returns the bytes for a branch to target. Long branches skip
+// over a JMP to the target using the branch with the opposite condition.
+func encodeBranch(in *inst, target int) ([]uint8, error) {
+	if in.long {
+		if target < 0 || target > 0xffff {
+			return nil, fmt.Errorf("branch target %d out of range", target)
+		}
+		form, err := instructionEntry(invertedBranch[in.op], Relative)
+		if err != nil {
+			return nil, err
+		}
+		jmp, err := instructionEntry(JMP, Absolute)
+		if err != nil {
+			return nil, err
+		}
+		return []uint8{form.opcode, 3, jmp.opcode, uint8(target & 0xff), uint8((target >> 8) & 0xff)}, nil
+	}
+	form, err := instructionEntry(in.op, Relative)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	// a.dumpAssembler(os.Stdout)
-	bytes := a.binaryImage()
-	for i, val := range bytes {
-		fmt.Printf("%d = %X\n", i, val)
+	offset := branchOffset(in.chunk.addr, target)
+	if err = branchRangeError(offset); err != nil {
+		return nil, err
 	}
-	err = writeProgram(a.origin, bytes, "out.prg")
+	return []uint8{form.opcode, uint8(offset)}, nil
+}
+
+func evaluate(e *expr.Node, sym map[string]int) (int, error) {
+	if e == nil {
+		return 0, fmt.Errorf("missing operand")
+	}
+	return e.Evaluate(expr.Symbols(sym))
+}
+
+// binaryImage runs both assembler passes over the parsed program and returns
+// the machine code as a single image, starting at the lowest address used.
+// Gaps between .ORG regions are filled with zeros.
+func (a *assembler) binaryImage() ([]uint8, error) {
+	if err := a.resolveAddresses(); err != nil {
+		return nil, err
+	}
+	if err := a.generateCode(); err != nil {
+		return nil, err
+	}
+	if err := a.checkOverlaps(); err != nil {
+		return nil, err
+	}
+	_, image := flatten(a.segments(), outputOptions{origin: a.origin})
+	return image, nil
+}
+
+// writeProgram writes a Commodore PRG file, which is the machine code with
+// the two byte little endian load address in front.
+func writeProgram(w io.Writer, startAddr int, bytes []uint8) (err error) {
+	startBytes := []uint8{uint8(startAddr & 0xff), uint8((startAddr >> 8) & 0xff)}
+
+	_, err = w.Write(startBytes)
+	if err != nil {
+		return fmt.Errorf("error writing bytes %v", err)
+	}
+	_, err = w.Write(bytes)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("error writing bytes %v", err)
 	}
+	return nil
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
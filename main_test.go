@@ -16,6 +16,187 @@ func TestInstructionString(t *testing.T) {
 	require.NotNil(t, e2)
 }
 
+// TestOpcodeTable cross checks every documented NMOS 6502 opcode against the
+// instruction table, and makes sure the table doesn't hold anything extra.
+func TestOpcodeTable(t *testing.T) {
+	type entry struct {
+		op   Instruction
+		mode AddressingMode
+	}
+	documented := map[uint8]entry{
+		0x00: {BRK, Implied},
+		0x01: {ORA, XIndexedIndirect},
+		0x05: {ORA, Zeropage},
+		0x06: {ASL, Zeropage},
+		0x08: {PHP, Implied},
+		0x09: {ORA, Immediate},
+		0x0a: {ASL, Accumulator},
+		0x0d: {ORA, Absolute},
+		0x0e: {ASL, Absolute},
+		0x10: {BPL, Relative},
+		0x11: {ORA, IndirectYIndexed},
+		0x15: {ORA, ZeropageXIndexed},
+		0x16: {ASL, ZeropageXIndexed},
+		0x18: {CLC, Implied},
+		0x19: {ORA, AbsoluteYIndex},
+		0x1d: {ORA, AbsoluteXIndex},
+		0x1e: {ASL, AbsoluteXIndex},
+		0x20: {JSR, Absolute},
+		0x21: {AND, XIndexedIndirect},
+		0x24: {BIT, Zeropage},
+		0x25: {AND, Zeropage},
+		0x26: {ROL, Zeropage},
+		0x28: {PLP, Implied},
+		0x29: {AND, Immediate},
+		0x2a: {ROL, Accumulator},
+		0x2c: {BIT, Absolute},
+		0x2d: {AND, Absolute},
+		0x2e: {ROL, Absolute},
+		0x30: {BMI, Relative},
+		0x31: {AND, IndirectYIndexed},
+		0x35: {AND, ZeropageXIndexed},
+		0x36: {ROL, ZeropageXIndexed},
+		0x38: {SEC, Implied},
+		0x39: {AND, AbsoluteYIndex},
+		0x3d: {AND, AbsoluteXIndex},
+		0x3e: {ROL, AbsoluteXIndex},
+		0x40: {RTI, Implied},
+		0x41: {EOR, XIndexedIndirect},
+		0x45: {EOR, Zeropage},
+		0x46: {LSR, Zeropage},
+		0x48: {PHA, Implied},
+		0x49: {EOR, Immediate},
+		0x4a: {LSR, Accumulator},
+		0x4c: {JMP, Absolute},
+		0x4d: {EOR, Absolute},
+		0x4e: {LSR, Absolute},
+		0x50: {BVC, Relative},
+		0x51: {EOR, IndirectYIndexed},
+		0x55: {EOR, ZeropageXIndexed},
+		0x56: {LSR, ZeropageXIndexed},
+		0x58: {CLI, Implied},
+		0x59: {EOR, AbsoluteYIndex},
+		0x5d: {EOR, AbsoluteXIndex},
+		0x5e: {LSR, AbsoluteXIndex},
+		0x60: {RTS, Implied},
+		0x61: {ADC, XIndexedIndirect},
+		0x65: {ADC, Zeropage},
+		0x66: {ROR, Zeropage},
+		0x68: {PLA, Implied},
+		0x69: {ADC, Immediate},
+		0x6a: {ROR, Accumulator},
+		0x6c: {JMP, Indirect},
+		0x6d: {ADC, Absolute},
+		0x6e: {ROR, Absolute},
+		0x70: {BVS, Relative},
+		0x71: {ADC, IndirectYIndexed},
+		0x75: {ADC, ZeropageXIndexed},
+		0x76: {ROR, ZeropageXIndexed},
+		0x78: {SEI, Implied},
+		0x79: {ADC, AbsoluteYIndex},
+		0x7d: {ADC, AbsoluteXIndex},
+		0x7e: {ROR, AbsoluteXIndex},
+		0x81: {STA, XIndexedIndirect},
+		0x84: {STY, Zeropage},
+		0x85: {STA, Zeropage},
+		0x86: {STX, Zeropage},
+		0x88: {DEY, Implied},
+		0x8a: {TXA, Implied},
+		0x8c: {STY, Absolute},
+		0x8d: {STA, Absolute},
+		0x8e: {STX, Absolute},
+		0x90: {BCC, Relative},
+		0x91: {STA, IndirectYIndexed},
+		0x94: {STY, ZeropageXIndexed},
+		0x95: {STA, ZeropageXIndexed},
+		0x96: {STX, ZeropageYIndexed},
+		0x98: {TYA, Implied},
+		0x99: {STA, AbsoluteYIndex},
+		0x9a: {TXS, Implied},
+		0x9d: {STA, AbsoluteXIndex},
+		0xa0: {LDY, Immediate},
+		0xa1: {LDA, XIndexedIndirect},
+		0xa2: {LDX, Immediate},
+		0xa4: {LDY, Zeropage},
+		0xa5: {LDA, Zeropage},
+		0xa6: {LDX, Zeropage},
+		0xa8: {TAY, Implied},
+		0xa9: {LDA, Immediate},
+		0xaa: {TAX, Implied},
+		0xac: {LDY, Absolute},
+		0xad: {LDA, Absolute},
+		0xae: {LDX, Absolute},
+		0xb0: {BCS, Relative},
+		0xb1: {LDA, IndirectYIndexed},
+		0xb4: {LDY, ZeropageXIndexed},
+		0xb5: {LDA, ZeropageXIndexed},
+		0xb6: {LDX, ZeropageYIndexed},
+		0xb8: {CLV, Implied},
+		0xb9: {LDA, AbsoluteYIndex},
+		0xba: {TSX, Implied},
+		0xbc: {LDY, AbsoluteXIndex},
+		0xbd: {LDA, AbsoluteXIndex},
+		0xbe: {LDX, AbsoluteYIndex},
+		0xc0: {CPY, Immediate},
+		0xc1: {CMP, XIndexedIndirect},
+		0xc4: {CPY, Zeropage},
+		0xc5: {CMP, Zeropage},
+		0xc6: {DEC, Zeropage},
+		0xc8: {INY, Implied},
+		0xc9: {CMP, Immediate},
+		0xca: {DEX, Implied},
+		0xcc: {CPY, Absolute},
+		0xcd: {CMP, Absolute},
+		0xce: {DEC, Absolute},
+		0xd0: {BNE, Relative},
+		0xd1: {CMP, IndirectYIndexed},
+		0xd5: {CMP, ZeropageXIndexed},
+		0xd6: {DEC, ZeropageXIndexed},
+		0xd8: {CLD, Implied},
+		0xd9: {CMP, AbsoluteYIndex},
+		0xdd: {CMP, AbsoluteXIndex},
+		0xde: {DEC, AbsoluteXIndex},
+		0xe0: {CPX, Immediate},
+		0xe1: {SBC, XIndexedIndirect},
+		0xe4: {CPX, Zeropage},
+		0xe5: {SBC, Zeropage},
+		0xe6: {INC, Zeropage},
+		0xe8: {INX, Implied},
+		0xe9: {SBC, Immediate},
+		0xea: {NOP, Implied},
+		0xec: {CPX, Absolute},
+		0xed: {SBC, Absolute},
+		0xee: {INC, Absolute},
+		0xf0: {BEQ, Relative},
+		0xf1: {SBC, IndirectYIndexed},
+		0xf5: {SBC, ZeropageXIndexed},
+		0xf6: {INC, ZeropageXIndexed},
+		0xf8: {SED, Implied},
+		0xf9: {SBC, AbsoluteYIndex},
+		0xfd: {SBC, AbsoluteXIndex},
+		0xfe: {INC, AbsoluteXIndex},
+	}
+	require.Len(t, documented, 151)
+	for opcode, e := range documented {
+		form, err := instructionEntry(e.op, e.mode)
+		require.Nil(t, err, "%s mode %d", e.op, e.mode)
+		require.Equal(t, opcode, form.opcode, "%s mode %d", e.op, e.mode)
+	}
+	count := 0
+	for i := range InstructionStrings {
+		forms, ok := InstructionSet[Instruction(i)]
+		require.True(t, ok, "missing %s", Instruction(i))
+		for _, form := range forms {
+			e, ok := documented[form.opcode]
+			require.True(t, ok, "undocumented opcode 0x%02x", form.opcode)
+			require.Equal(t, entry{Instruction(i), form.mode}, e)
+			count++
+		}
+	}
+	require.Equal(t, 151, count)
+	require.Len(t, InstructionSet, 56)
+}
+
 func TestParseInstruction(t *testing.T) {
 	a := assembler{}
 	err := a.parseReader(strings.NewReader(" LDA #4"))
@@ -49,6 +230,153 @@ func TestParseLabel(t *testing.T) {
 	require.Equal(t, "TESTLABEL", ln.Name)
 }
 
+func TestLabelNames(t *testing.T) {
+	src := ` .ORG $1000
+loop1: NOP
+_tmp_2 NOP
+ JMP loop1+_tmp_2
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, 0x1000, a.sym["loop1"])
+	require.Equal(t, 0x1001, a.sym["_tmp_2"])
+	require.Equal(t, []uint8{0xea, 0xea, 0x4c, 0x01, 0x20}, bytes)
+}
+
+func TestNumberLiterals(t *testing.T) {
+	src := ` .ORG $1000
+ .BYTE %1000_0001, 'A', @17, 0o17, 0b11, ';' ; comment
+ LDA #%1010
+ LDX #'Z'-'A'
+ .WORD 64_000
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{
+		0x81, 0x41, 0x0f, 0x0f, 0x03, 0x3b,
+		0xa9, 0x0a, 0xa2, 0x19, 0x00, 0xfa,
+	}, bytes)
+}
+
+func TestProgramCounter(t *testing.T) {
+	src := `* = $1000
+start: LDX #2
+ DEX
+ BNE *-1
+here = *
+ .BYTE * - start, $ - start, <here
+ JMP *
+    *=*+2
+ .WORD *
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, 0x1000, a.origin)
+	require.Equal(t, 0x1005, a.sym["here"])
+	require.Equal(t, []uint8{
+		0xa2, 0x02, 0xca, 0xd0, 0xfd,
+		0x05, 0x05, 0x05,
+		0x4c, 0x08, 0x10,
+		0x00, 0x00,
+		0x0d, 0x10,
+	}, bytes)
+	_, found := a.sym["*"]
+	require.False(t, found)
+
+	a = assembler{}
+	err = a.parseReader(strings.NewReader(" .IF * > $1000\n .ENDIF\n"))
+	require.ErrorContains(t, err, "1:6: error: the program counter isn't known yet, conditions can't use it")
+}
+
+func TestLocalLabels(t *testing.T) {
+	src := ` .ORG $1000
+first: LDX #2
+@loop: DEX
+ BNE @loop
+ BEQ .done
+.done RTS
+second: LDY #2
+@loop: DEY
+ BNE @loop
+.done RTS
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{
+		0xa2, 0x02, 0xca, 0xd0, 0xfd, 0xf0, 0x00, 0x60,
+		0xa0, 0x02, 0x88, 0xd0, 0xfd, 0x60,
+	}, bytes)
+	require.Equal(t, 0x1002, a.sym["first@loop"])
+	require.Equal(t, 0x100a, a.sym["second@loop"])
+	require.Equal(t, 0x1007, a.sym["first.done"])
+
+	a = assembler{}
+	err = a.parseReader(strings.NewReader("start NOP\n@x NOP\n@x NOP\n"))
+	require.ErrorContains(t, err, "3:1: error: @x redefined, first defined at 2:1")
+}
+
+func TestAnonymousLabels(t *testing.T) {
+	src := ` .ORG $1000
+- DEX
+ BNE -
+ BEQ +
+ BCC ++
++ NOP
+- INY
++ BNE --
+ JMP -
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{
+		0xca, 0xd0, 0xfd, 0xf0, 0x02, 0x90, 0x02, 0xea,
+		0xc8, 0xd0, 0xf5, 0x4c, 0x08, 0x10,
+	}, bytes)
+	require.Empty(t, a.symbols())
+
+	a = assembler{}
+	err = a.parseReader(strings.NewReader("-- NOP\n"))
+	require.ErrorContains(t, err, "1:1: error: anonymous labels are a single + or -")
+}
+
+// TestAnonymousLabelBeforeConst makes sure a constant assignment only turns
+// the named labels waiting for an instruction into constants, leaving an
+// anonymous label in between as a label.
+func TestAnonymousLabelBeforeConst(t *testing.T) {
+	src := ` .ORG $1000
+FOO
+-
+BAR = 5
+ LDA #FOO+BAR
+ BNE -
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{0xa9, 0x0a, 0xd0, 0xfc}, bytes)
+	require.Equal(t, 5, a.sym["FOO"])
+	require.Equal(t, 5, a.sym["BAR"])
+	require.Equal(t, 0x1000, a.sym["-@1"])
+	for _, l := range a.lines {
+		for _, n := range l.nodes {
+			if label, ok := n.(*LabelNode); ok {
+				require.Equal(t, "-@1", label.Name)
+			}
+		}
+	}
+}
+
 func TestParsePseudo(t *testing.T) {
 	a := assembler{}
 	err := a.parseReader(strings.NewReader(" .org"))
@@ -70,18 +398,286 @@ func TestParsePseudoMultiarg(t *testing.T) {
 	require.Len(t, pn.Pseudo.Args, 3)
 }
 
-/*
 func TestImmediateExpr(t *testing.T) {
 	a := assembler{}
 	err := a.parseReader(strings.NewReader(" LDA #(2+4)"))
 	if err != nil {
 		t.Fatal("Error from parseReader")
 	}
-	bytes := a.binaryImage()
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
 	require.Equal(t, bytes[0], uint8(0xa9))
 	require.Equal(t, bytes[1], uint8(6))
 }
 
+func TestTwoPassLabels(t *testing.T) {
+	src := ` .ORG $1000
+start: LDA #1
+ STA later
+later: STA start,X
+ RTS
+`
+	a := assembler{origin: 0xc000}
+	err := a.parseReader(strings.NewReader(src))
+	require.Nil(t, err)
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, 0x1000, a.origin)
+	require.Equal(t, 0x1000, a.sym["start"])
+	require.Equal(t, 0x1005, a.sym["later"])
+	require.Equal(t, []uint8{
+		0xa9, 0x01,
+		0x8d, 0x05, 0x10,
+		0x9d, 0x00, 0x10,
+		0x60,
+	}, bytes)
+}
+
+func TestUndefinedLabel(t *testing.T) {
+	a := assembler{}
+	err := a.parseReader(strings.NewReader(" sta nowhere ; store it"))
+	require.Nil(t, err)
+	_, err = a.binaryImage()
+	require.ErrorContains(t, err, "undefined symbol: nowhere")
+}
+
+func TestZeropageSelection(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []uint8
+		err      bool
+	}{
+		{input: " LDA $10", expected: []uint8{0xa5, 0x10}},
+		{input: " LDA $1000", expected: []uint8{0xad, 0x00, 0x10}},
+		{input: " lda $10,x", expected: []uint8{0xb5, 0x10}},
+		{input: " LDA $10,Y", expected: []uint8{0xb9, 0x10, 0x00}},
+		{input: " LDX $10,Y", expected: []uint8{0xb6, 0x10}},
+		{input: " STX $10,Y", expected: []uint8{0x96, 0x10}},
+		{input: " JSR $10", expected: []uint8{0x20, 0x10, 0x00}},
+		{input: " LDA.a $10", expected: []uint8{0xad, 0x10, 0x00}},
+		{input: " LDA a:$10,X", expected: []uint8{0xbd, 0x10, 0x00}},
+		{input: " LDA.z $10", expected: []uint8{0xa5, 0x10}},
+		{input: " LDA z:$10", expected: []uint8{0xa5, 0x10}},
+		{input: " LDA.z $1000", err: true},
+		{input: " STX.a $10,Y", err: true},
+		{input: " JSR.z $10", err: true},
+		{input: " LDA.q $10", err: true},
+	}
+	for _, tc := range tests {
+		a := assembler{}
+		err := a.parseReader(strings.NewReader(tc.input))
+		if err == nil {
+			var bytes []uint8
+			bytes, err = a.binaryImage()
+			if !tc.err {
+				require.Equal(t, tc.expected, bytes, tc.input)
+			}
+		}
+		require.Equal(t, tc.err, err != nil, tc.input)
+	}
+}
+
+// TestZeropageForwardReference checks that an instruction referring to a
+// label later in the program starts out absolute and shrinks once the label
+// is known to be in the zeropage, moving everything after it down a byte.
+func TestZeropageForwardReference(t *testing.T) {
+	src := ` .ORG $10
+ LDA data
+ JMP data
+data: RTS
+`
+	a := assembler{}
+	err := a.parseReader(strings.NewReader(src))
+	require.Nil(t, err)
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, 0x15, a.sym["data"])
+	require.Equal(t, []uint8{0xa5, 0x15, 0x4c, 0x15, 0x00, 0x60}, bytes)
+}
+
+func TestBranch(t *testing.T) {
+	src := ` .ORG $1000
+loop: DEX
+ BNE loop
+ BEQ done
+ NOP
+done: RTS
+`
+	a := assembler{}
+	err := a.parseReader(strings.NewReader(src))
+	require.Nil(t, err)
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{0xca, 0xd0, 0xfd, 0xf0, 0x01, 0xea, 0x60}, bytes)
+}
+
+func TestBranchOutOfRange(t *testing.T) {
+	src := " BNE done\n" + strings.Repeat(" NOP\n", 130) + "done: RTS\n"
+	a := assembler{}
+	err := a.parseReader(strings.NewReader(src))
+	require.Nil(t, err)
+	_, err = a.binaryImage()
+	require.ErrorContains(t, err, "1:2: error: branch out of range by 3 bytes")
+
+	src = "back: NOP\n" + strings.Repeat(" NOP\n", 127) + " BCC back\n"
+	a = assembler{}
+	err = a.parseReader(strings.NewReader(src))
+	require.Nil(t, err)
+	_, err = a.binaryImage()
+	require.ErrorContains(t, err, "129:2: error: branch out of range by 2 bytes")
+}
+
+func TestLongBranch(t *testing.T) {
+	src := " .ORG $1000\n BNE done\n BEQ near\nnear:" + strings.Repeat(" NOP\n", 130) + "done: RTS\n"
+	a := assembler{longBranches: true}
+	err := a.parseReader(strings.NewReader(src))
+	require.Nil(t, err)
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, 0x1089, a.sym["done"])
+	require.Equal(t, []uint8{0xf0, 0x03, 0x4c, 0x89, 0x10}, bytes[:5])
+	require.Equal(t, []uint8{0xf0, 0x00}, bytes[5:7])
+}
+
+func TestAccumulator(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []uint8
+	}{
+		{input: " ASL", expected: []uint8{0x0a}},
+		{input: " ASL A", expected: []uint8{0x0a}},
+		{input: " lsr a", expected: []uint8{0x4a}},
+		{input: " ROL A ; rotate", expected: []uint8{0x2a}},
+		{input: " ROR ; rotate", expected: []uint8{0x6a}},
+		{input: " .ORG $1000\nA: LDA A", expected: []uint8{0xad, 0x00, 0x10}},
+		{input: " .ORG $1000\nA: ASL a:A", expected: []uint8{0x0e, 0x00, 0x10}},
+		{input: " .ORG $1000\nAb: ASL Ab", expected: []uint8{0x0e, 0x00, 0x10}},
+	}
+	for _, tc := range tests {
+		a := assembler{}
+		err := a.parseReader(strings.NewReader(tc.input))
+		require.Nil(t, err, tc.input)
+		bytes, err := a.binaryImage()
+		require.Nil(t, err, tc.input)
+		require.Equal(t, tc.expected, bytes, tc.input)
+	}
+}
+
+func TestOperandErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: " LDA $10$20", err: "1:6: error: unexpected text $20"},
+		{input: " LDA ($10 $20),Y", err: "1:6: error: unexpected text $20"},
+		{input: " LDA $10 , X", err: "1:10: error: unexpected text , X"},
+	}
+	for _, tc := range tests {
+		a := assembler{}
+		err := a.parseReader(strings.NewReader(tc.input))
+		require.ErrorContains(t, err, tc.err, tc.input)
+	}
+}
+
+func TestIndirectSpaces(t *testing.T) {
+	a := assembler{}
+	err := a.parseReader(strings.NewReader(" LDA ( $10 ),Y"))
+	require.Nil(t, err)
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []uint8{0xb1, 0x10}, bytes)
+}
+
+func TestDataDirectives(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []uint8
+		err      bool
+		parseErr string
+	}{
+		{input: " .BYTE 1, 2,3", expected: []uint8{1, 2, 3}},
+		{input: " .byte -1, $ff ; bytes", expected: []uint8{0xff, 0xff}},
+		{input: " .BYTE 256", err: true},
+		{input: " .BYTE -129", err: true},
+		{input: " .BYTE \"AB\", 0", expected: []uint8{'A', 'B', 0}},
+		{input: " .WORD $1234, 1", expected: []uint8{0x34, 0x12, 0x01, 0x00}},
+		{input: " .WORD $10000", err: true},
+		{input: " .WORD \"AB\"", err: true},
+		{input: " .DWORD $12345678", expected: []uint8{0x78, 0x56, 0x34, 0x12}},
+		{input: " .DWORD $FFFFFFFF", expected: []uint8{0xff, 0xff, 0xff, 0xff}},
+		{input: " .DWORD $100000000", parseErr: "1:9: error: bad number $100000000, larger than 32 bits"},
+		{input: " .BYTE 1 2", parseErr: "1:10: error: unexpected text 2"},
+		{input: " .BYTE 1,", parseErr: "1:9: error: missing argument after ,"},
+		{input: " .WORD 1, ; two", parseErr: "1:9: error: missing argument after ,"},
+		{input: " .DBYT $1234", expected: []uint8{0x12, 0x34}},
+		{input: " .TEXT \"HI, THERE\"", expected: []uint8("HI, THERE")},
+		{input: " .FILL 3, $ea", expected: []uint8{0xea, 0xea, 0xea}},
+		{input: " .FILL 3", err: true},
+		{input: " .RES 2\n .BYTE 1", expected: []uint8{1}},
+		{input: " .BYTE 1\n .RES 2\n .BYTE 2", expected: []uint8{1, 0, 0, 2}},
+		{input: " .RES -1", err: true},
+	}
+	for _, tc := range tests {
+		a := assembler{}
+		err := a.parseReader(strings.NewReader(tc.input))
+		if tc.parseErr != "" {
+			require.ErrorContains(t, err, tc.parseErr, tc.input)
+			continue
+		}
+		require.Nil(t, err, tc.input)
+		bytes, err := a.binaryImage()
+		require.Equal(t, tc.err, err != nil, tc.input)
+		if !tc.err {
+			require.Equal(t, tc.expected, bytes, tc.input)
+		}
+	}
+}
+
+// TestDataLabels checks that data directives move the location counter,
+// including a .RES sized by a label later in the program.
+func TestDataLabels(t *testing.T) {
+	src := ` .ORG $1000
+ .RES end-table
+table: .WORD start, end
+start: .TEXT "AB"
+end: LDA table
+`
+	a := assembler{}
+	err := a.parseReader(strings.NewReader(src))
+	require.Nil(t, err)
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, 0x1006, a.sym["table"])
+	require.Equal(t, 0x100a, a.sym["start"])
+	require.Equal(t, 0x100c, a.sym["end"])
+	require.Equal(t, []uint8{
+		0x0a, 0x10, 0x0c, 0x10,
+		'A', 'B',
+		0xad, 0x06, 0x10,
+	}, bytes)
+}
+
+// TestReserve makes sure .RES only moves the location counter, so variables
+// can be declared in memory that isn't part of the program.
+func TestReserve(t *testing.T) {
+	src := ` .ORG $FB
+ptr: .RES 2
+tmp: .RES 1
+ .ORG $C000
+ LDA (ptr),Y
+ STA tmp
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, 0xfb, a.sym["ptr"])
+	require.Equal(t, 0xfd, a.sym["tmp"])
+	require.Equal(t, 0xc000, a.origin)
+	require.Equal(t, []uint8{0xb1, 0xfb, 0x85, 0xfd}, bytes)
+	require.Equal(t, []binaryChunk{{addr: 0xc000, mem: bytes}}, a.segments())
+}
+
 func TestConst(t *testing.T) {
 	a := assembler{
 		constants: make(map[string]int),
@@ -90,6 +686,8 @@ func TestConst(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error from parseReader")
 	}
+	_, err = a.binaryImage()
+	require.Nil(t, err)
 	require.Equal(t, a.constants["TESTVAL"], 1234)
 }
 
@@ -101,7 +699,123 @@ func TestMultiConst(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error from parseReader")
 	}
+	_, err = a.binaryImage()
+	require.Nil(t, err)
 	require.Equal(t, a.constants["TESTVAL"], 345)
 	require.Equal(t, a.constants["TESTONE"], 345)
 }
-*/
+
+func TestConstForwardReference(t *testing.T) {
+	src := `SCREEN = BASE + $400
+ LDA SCREEN
+ LDX ZP
+ STA far
+BASE .EQU $1000 ; .EQU works too
+ZP = FAR - $2000
+far: RTS
+FAR = far
+`
+	a := assembler{origin: 0x2000}
+	err := a.parseReader(strings.NewReader(src))
+	require.Nil(t, err)
+	bytes, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, 0x1400, a.constants["SCREEN"])
+	require.Equal(t, 0x2008, a.sym["far"])
+	require.Equal(t, 8, a.constants["ZP"])
+	require.NotContains(t, a.constants, "far")
+	require.Equal(t, []uint8{
+		0xad, 0x00, 0x14,
+		0xa6, 0x08,
+		0x8d, 0x08, 0x20,
+		0x60,
+	}, bytes)
+}
+
+func TestConstErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		parseErr string
+		asmErr   string
+	}{
+		{
+			input:  "A = B\nB = C + 1\nC = B",
+			asmErr: "1:5: error: circular definition: B -> C -> B",
+		}, {
+			input:  "A = A",
+			asmErr: "1:5: error: circular definition: A -> A",
+		}, {
+			input:  "A = B",
+			asmErr: "1:5: error: undefined symbol: B",
+		}, {
+			input:    "A = 1\n NOP\nA = 2",
+			parseErr: "3:1: error: A redefined, first defined at 1:1",
+		}, {
+			input:    "A: NOP\nA = 2",
+			parseErr: "2:1: error: A redefined, first defined at 1:1",
+		}, {
+			input:  " .ORG $1000\n .RES X\nX = end - $1000 + 1\nend:",
+			asmErr: "3:5: error: addresses did not settle after 16 passes",
+		}, {
+			input:    " .EQU 2",
+			parseErr: "1:2: error: constant assignment without a name",
+		},
+	}
+	for _, tc := range tests {
+		a := assembler{}
+		err := a.parseReader(strings.NewReader(tc.input))
+		if tc.parseErr != "" {
+			require.ErrorContains(t, err, tc.parseErr, tc.input)
+			continue
+		}
+		require.Nil(t, err, tc.input)
+		_, err = a.binaryImage()
+		require.ErrorContains(t, err, tc.asmErr, tc.input)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	src := ` LDA #1
+ STZ $10
+ LDA $10 junk
+A: NOP
+A = 2
+ .BYTE 1,)
+ LDA #(1
+ .BYTE 1 +
+ LDA ()
+ .WORD 1,,2
+`
+	a := assembler{file: "test.asm"}
+	err := a.parseReader(strings.NewReader(src))
+	var diags Diagnostics
+	require.ErrorAs(t, err, &diags)
+	require.Len(t, diags, 8)
+	require.Equal(t, Position{File: "test.asm", Line: 2, Col: 2}, diags[0].Pos)
+	require.Equal(t, 5, diags[0].EndCol)
+	require.Equal(t, SeverityError, diags[0].Severity)
+	require.Equal(t, "test.asm:2:2: error: STZ is not a valid instruction", diags[0].Error())
+	require.Equal(t, "test.asm:3:10: error: unexpected text junk", diags[1].Error())
+	require.Equal(t, 14, diags[1].EndCol)
+	require.Equal(t, "test.asm:5:1: error: A redefined, first defined at test.asm:4:1", diags[2].Error())
+	require.Equal(t, 6, diags[3].Pos.Line)
+	require.Equal(t, 10, diags[3].Pos.Col)
+	require.Equal(t, "test.asm:7:6: error: missing )", diags[4].Error())
+	require.Equal(t, "test.asm:8:8: error: missing operand for +", diags[5].Error())
+	require.Equal(t, "test.asm:9:6: error: empty expression", diags[6].Error())
+	require.Equal(t, "test.asm:10:9: error: missing argument after ,", diags[7].Error())
+	// The lines that parsed are still in the program
+	require.Len(t, a.prg, 3)
+}
+
+func TestDiagnosticsCodeGeneration(t *testing.T) {
+	a := assembler{}
+	err := a.parseReader(strings.NewReader(" .BYTE 300\n LDA #$100\n NOP"))
+	require.Nil(t, err)
+	_, err = a.binaryImage()
+	var diags Diagnostics
+	require.ErrorAs(t, err, &diags)
+	require.Len(t, diags, 2)
+	require.Equal(t, "1:2: error: value 300 does not fit in 8 bits", diags[0].Error())
+	require.Equal(t, "2:2: error: operand 256 out of range for LDA", diags[1].Error())
+}
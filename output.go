@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// outputOptions are the settings from the command line that the output
+// formats need.
+type outputOptions struct {
+	origin    int   // Load address when the program is empty
+	fill      uint8 // Byte used to fill gaps in flat formats
+	recordLen int   // Data bytes per record for the hex formats
+}
+
+// segments returns the assembled program as address tagged chunks, merging
+// the chunks of neighbouring nodes into one when they're contiguous.
+// binaryImage must have been run first.
+func (a *assembler) segments() []binaryChunk {
+	segs := []binaryChunk{}
+	for _, node := range a.prg {
+		chunk, ok := nodeChunk(node)
+		if !ok || len(chunk.mem) == 0 {
+			continue
+		}
+		if l := len(segs); l > 0 && segs[l-1].addr+len(segs[l-1].mem) == chunk.addr {
+			segs[l-1].mem = append(segs[l-1].mem, chunk.mem...)
+			continue
+		}
+		segs = append(segs, binaryChunk{addr: chunk.addr, mem: append([]uint8{}, chunk.mem...)})
+	}
+	return segs
+}
+
+// checkOverlaps makes sure no two nodes emit bytes at the same address, which
+// happens when an .ORG moves back over code that's already been placed. A
+// diagnostic is returned for every node that overlaps one before it, naming
+// the line it collides with.
+func (a *assembler) checkOverlaps() error {
+	type placed struct {
+		index int // Position in the program, to report the later node
+		node  Node
+		chunk binaryChunk
+	}
+	nodes := []placed{}
+	for i, node := range a.prg {
+		if chunk, ok := nodeChunk(node); ok && len(chunk.mem) > 0 {
+			nodes = append(nodes, placed{i, node, chunk})
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].chunk.addr < nodes[j].chunk.addr })
+	var diags Diagnostics
+	var last placed
+	lastEnd := 0
+	for i, p := range nodes {
+		if i > 0 && p.chunk.addr < lastEnd {
+			first, second := last, p
+			if second.index < first.index {
+				first, second = second, first
+			}
+			err := fmt.Errorf("$%04X-$%04X overlaps $%04X-$%04X from %v",
+				second.chunk.addr, second.chunk.addr+len(second.chunk.mem)-1,
+				first.chunk.addr, first.chunk.addr+len(first.chunk.mem)-1, first.node.Pos())
+			diags = append(diags, diagnosticAt(second.node.Pos(), err))
+		}
+		if end := p.chunk.addr + len(p.chunk.mem); i == 0 || end > lastEnd {
+			last, lastEnd = p, end
+		}
+	}
+	return diags.err()
+}
+
+// checkGaps returns an error for the first gap between segments, for the flat
+// formats when gaps aren't being filled.
+func checkGaps(segs []binaryChunk) error {
+	sorted := sortedSegments(segs)
+	for i := 1; i < len(sorted); i++ {
+		end := sorted[i-1].addr + len(sorted[i-1].mem)
+		if end < sorted[i].addr {
+			return fmt.Errorf("gap in the program at $%04X-$%04X, use --fill-gaps to fill it", end, sorted[i].addr-1)
+		}
+	}
+	return nil
+}
+
+// sortedSegments returns a copy of segs in address order.
+func sortedSegments(segs []binaryChunk) []binaryChunk {
+	sorted := append([]binaryChunk{}, segs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].addr < sorted[j].addr })
+	return sorted
+}
+
+// flatten turns segments into a single image starting at the lowest address,
+// with any gaps between them filled.
+func flatten(segs []binaryChunk, opts outputOptions) (start int, image []uint8) {
+	if len(segs) == 0 {
+		return opts.origin, []uint8{}
+	}
+	sorted := sortedSegments(segs)
+	start = sorted[0].addr
+	for _, seg := range sorted {
+		for start+len(image) < seg.addr {
+			image = append(image, opts.fill)
+		}
+		image = append(image, seg.mem...)
+	}
+	return
+}
+
+// padSegments extends the program with fill bytes so it covers size bytes from
+// origin. It's an error for the program to already be bigger than size.
+func padSegments(segs []binaryChunk, origin int, size int, fill uint8) ([]binaryChunk, error) {
+	end := origin
+	for _, seg := range segs {
+		end = max(end, seg.addr+len(seg.mem))
+	}
+	if end-origin > size {
+		return nil, fmt.Errorf("program is %d bytes, too big to pad to %d", end-origin, size)
+	}
+	if end-origin == size {
+		return segs, nil
+	}
+	padding := binaryChunk{addr: end, mem: make([]uint8, origin+size-end)}
+	for i := range padding.mem {
+		padding.mem[i] = fill
+	}
+	return append(segs, padding), nil
+}
+
+// writeFlatProgram writes a Commodore PRG file from the segments.
+func writeFlatProgram(w io.Writer, segs []binaryChunk, opts outputOptions) error {
+	start, image := flatten(segs, opts)
+	return writeProgram(w, start, image)
+}
+
+// writeRaw writes just the machine code, with no load address. This is the
+// format for ROM images and EPROM programmers.
+func writeRaw(w io.Writer, segs []binaryChunk, opts outputOptions) error {
+	_, image := flatten(segs, opts)
+	_, err := w.Write(image)
+	if err != nil {
+		return fmt.Errorf("error writing bytes %v", err)
+	}
+	return nil
+}
+
+// records splits the segments into pieces of at most recordLen bytes, never
+// joining separate segments, so gaps in the program stay gaps in the output.
+func records(segs []binaryChunk, recordLen int) []binaryChunk {
+	recs := []binaryChunk{}
+	for _, seg := range sortedSegments(segs) {
+		for i := 0; i < len(seg.mem); i += recordLen {
+			recs = append(recs, binaryChunk{addr: seg.addr + i, mem: seg.mem[i:min(len(seg.mem), i+recordLen)]})
+		}
+	}
+	return recs
+}
+
+// checkAddressRange makes sure every byte of the segments can be addressed
+// with the given number of bits.
+func checkAddressRange(segs []binaryChunk, bits uint) error {
+	for _, seg := range segs {
+		if seg.addr < 0 || seg.addr+len(seg.mem) > 1<<bits {
+			return fmt.Errorf("segment at $%04X doesn't fit in %d bit addresses", seg.addr, bits)
+		}
+	}
+	return nil
+}
+
+// writeIntelHex writes the segments as Intel HEX data records followed by an
+// end of file record:
+//
+//	:02C00000A9048B
+//	:00000001FF
+func writeIntelHex(w io.Writer, segs []binaryChunk, opts outputOptions) error {
+	if err := checkAddressRange(segs, 16); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for _, rec := range records(segs, opts.recordLen) {
+		fields := append([]uint8{uint8(len(rec.mem)), uint8(rec.addr >> 8), uint8(rec.addr), 0x00}, rec.mem...)
+		sum := uint8(0)
+		for _, b := range fields {
+			sum += b
+		}
+		fmt.Fprintf(bw, ":%s%02X\n", hexString(fields), -sum)
+	}
+	fmt.Fprintln(bw, ":00000001FF")
+	return bw.Flush()
+}
+
+// writeSRecord writes the segments as Motorola S-records. addrBytes picks the
+// flavour, 2 for S19 files using S1/S9 records and 3 for S28 files using
+// S2/S8 records. The terminating record holds the origin as the start
+// address.
+func writeSRecord(w io.Writer, segs []binaryChunk, opts outputOptions, addrBytes int) error {
+	if err := checkAddressRange(segs, uint(8*addrBytes)); err != nil {
+		return err
+	}
+	dataType, endType := 1, 9
+	if addrBytes == 3 {
+		dataType, endType = 2, 8
+	}
+	bw := bufio.NewWriter(w)
+	writeRecord := func(typ int, addr int, addrLen int, data []uint8) {
+		fields := []uint8{uint8(addrLen + len(data) + 1)}
+		for i := addrLen - 1; i >= 0; i-- {
+			fields = append(fields, uint8(addr>>(8*i)))
+		}
+		fields = append(fields, data...)
+		sum := uint8(0)
+		for _, b := range fields {
+			sum += b
+		}
+		fmt.Fprintf(bw, "S%d%s%02X\n", typ, hexString(fields), ^sum)
+	}
+	writeRecord(0, 0, 2, nil)
+	for _, rec := range records(segs, opts.recordLen) {
+		writeRecord(dataType, rec.addr, addrBytes, rec.mem)
+	}
+	writeRecord(endType, opts.origin, addrBytes, nil)
+	return bw.Flush()
+}
+
+func hexString(b []uint8) string {
+	return strings.ToUpper(fmt.Sprintf("%x", b))
+}
+
+// parseWindow reads an address range given as START:END, where both ends are
+// included in the range.
+func parseWindow(s string) (start int, end int, err error) {
+	startStr, endStr, found := strings.Cut(s, ":")
+	if !found {
+		return 0, 0, fmt.Errorf("expected START:END")
+	}
+	if start, err = parseValue(startStr); err != nil {
+		return
+	}
+	if end, err = parseValue(endStr); err != nil {
+		return
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("end $%04X is before start $%04X", end, start)
+	}
+	return
+}
+
+// checkWindow makes sure everything the program emits lands between start and
+// end inclusive. A diagnostic is returned for each node that doesn't.
+func (a *assembler) checkWindow(start int, end int) error {
+	var diags Diagnostics
+	for _, node := range a.prg {
+		chunk, ok := nodeChunk(node)
+		if !ok || len(chunk.mem) == 0 {
+			continue
+		}
+		last := chunk.addr + len(chunk.mem) - 1
+		if chunk.addr < start || last > end {
+			err := fmt.Errorf("$%04X-$%04X is outside the ROM window $%04X-$%04X", chunk.addr, last, start, end)
+			diags = append(diags, diagnosticAt(node.Pos(), err))
+		}
+	}
+	return diags.err()
+}
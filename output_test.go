@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteRaw(t *testing.T) {
+	var out bytes.Buffer
+	segs := []binaryChunk{{addr: 0x8000, mem: []uint8{0xa9, 0x01}}}
+	require.Nil(t, writeRaw(&out, segs, outputOptions{origin: 0x8000}))
+	require.Equal(t, []uint8{0xa9, 0x01}, out.Bytes())
+}
+
+func TestFlatten(t *testing.T) {
+	segs := []binaryChunk{
+		{addr: 0x1004, mem: []uint8{3}},
+		{addr: 0x1000, mem: []uint8{1, 2}},
+	}
+	start, image := flatten(segs, outputOptions{fill: 0xea})
+	require.Equal(t, 0x1000, start)
+	require.Equal(t, []uint8{1, 2, 0xea, 0xea, 3}, image)
+	start, image = flatten(nil, outputOptions{origin: 0xc000})
+	require.Equal(t, 0xc000, start)
+	require.Empty(t, image)
+}
+
+func TestPadSegments(t *testing.T) {
+	segs, err := padSegments([]binaryChunk{{addr: 0x10, mem: []uint8{1, 2}}}, 0x10, 4, 0xff)
+	require.Nil(t, err)
+	_, image := flatten(segs, outputOptions{})
+	require.Equal(t, []uint8{1, 2, 0xff, 0xff}, image)
+	_, err = padSegments([]binaryChunk{{addr: 0, mem: []uint8{1, 2, 3}}}, 0, 2, 0)
+	require.ErrorContains(t, err, "too big to pad to 2")
+}
+
+func TestSegments(t *testing.T) {
+	src := ` .ORG $1000
+ NOP
+ .BYTE 1, 2
+ .ORG $2000
+ RTS
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	_, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Equal(t, []binaryChunk{
+		{addr: 0x1000, mem: []uint8{0xea, 1, 2}},
+		{addr: 0x2000, mem: []uint8{0x60}},
+	}, a.segments())
+}
+
+func TestWriteHexFormats(t *testing.T) {
+	segs := []binaryChunk{
+		{addr: 0xc000, mem: []uint8{0xa9, 0x04, 0x8d, 0x20, 0xd0}},
+		{addr: 0xc100, mem: []uint8{0x60}},
+	}
+	opts := outputOptions{origin: 0xc000, recordLen: 4}
+	testCases := []struct {
+		name  string
+		write func(w io.Writer, segs []binaryChunk, opts outputOptions) error
+		want  string
+	}{
+		{"hex", writeIntelHex, `:04C00000A9048D20E2
+:01C00400D06B
+:01C1000060DE
+:00000001FF
+`},
+		{"s19", outputFormats["s19"].write, `S0030000FC
+S107C000A9048D20DE
+S104C004D067
+S104C10060DA
+S903C0003C
+`},
+		{"s28", outputFormats["s28"].write, `S0030000FC
+S20800C000A9048D20DD
+S20500C004D066
+S20500C10060D9
+S80400C0003B
+`},
+	}
+	for _, tc := range testCases {
+		var out bytes.Buffer
+		require.Nil(t, tc.write(&out, segs, opts), tc.name)
+		require.Equal(t, tc.want, out.String(), tc.name)
+	}
+}
+
+func TestWriteHexAddressRange(t *testing.T) {
+	var out bytes.Buffer
+	segs := []binaryChunk{{addr: 0xffff, mem: []uint8{1, 2}}}
+	require.ErrorContains(t, writeIntelHex(&out, segs, outputOptions{recordLen: 16}), "16 bit")
+	require.Nil(t, writeSRecord(&out, segs, outputOptions{recordLen: 16}, 3))
+}
+
+func TestParseWindow(t *testing.T) {
+	start, end, err := parseWindow("$8000:$9FFF")
+	require.Nil(t, err)
+	require.Equal(t, 0x8000, start)
+	require.Equal(t, 0x9fff, end)
+	_, _, err = parseWindow("$8000")
+	require.NotNil(t, err)
+	_, _, err = parseWindow("$9000:$8000")
+	require.NotNil(t, err)
+}
+
+func TestCheckWindow(t *testing.T) {
+	src := ` .ORG $9FFE
+ NOP
+ JMP $8000
+ .BYTE 1
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	_, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Nil(t, a.checkWindow(0x9ffe, 0xa003))
+	err = a.checkWindow(0x8000, 0x9fff)
+	var diags Diagnostics
+	require.ErrorAs(t, err, &diags)
+	require.Len(t, diags, 2)
+	require.Equal(t, "3:2: error: $9FFF-$A001 is outside the ROM window $8000-$9FFF", diags[0].Error())
+	require.Equal(t, 4, diags[1].Pos.Line)
+}
+
+func TestCheckOverlaps(t *testing.T) {
+	src := ` .ORG $1000
+ LDA #1
+ STA $2000
+ .ORG $1003
+ .BYTE 1, 2
+`
+	a := assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	_, err := a.binaryImage()
+	var diags Diagnostics
+	require.ErrorAs(t, err, &diags)
+	require.Len(t, diags, 1)
+	require.Equal(t, "5:2: error: $1003-$1004 overlaps $1002-$1004 from 3:2", diags[0].Error())
+
+	src = ` .ORG $2000
+ RTS
+ .ORG $1000
+ NOP
+`
+	a = assembler{}
+	require.Nil(t, a.parseReader(strings.NewReader(src)))
+	image, err := a.binaryImage()
+	require.Nil(t, err)
+	require.Len(t, image, 0x1001)
+	require.Equal(t, uint8(0xea), image[0])
+	require.Equal(t, uint8(0x60), image[0x1000])
+}
+
+func TestCheckGaps(t *testing.T) {
+	require.Nil(t, checkGaps([]binaryChunk{{addr: 0x10, mem: []uint8{1}}, {addr: 0x11, mem: []uint8{2}}}))
+	err := checkGaps([]binaryChunk{{addr: 0x20, mem: []uint8{2}}, {addr: 0x10, mem: []uint8{1}}})
+	require.ErrorContains(t, err, "gap in the program at $0011-$001F")
+}
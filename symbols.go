@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// symbolEntry is a single symbol as written to the exported symbol files.
+type symbolEntry struct {
+	Name   string `json:"name"`
+	Value  int    `json:"value"`
+	Kind   string `json:"kind"`
+	File   string `json:"file,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Column int    `json:"column,omitempty"`
+}
+
+// symbols returns every label and constant with a value, sorted by name.
+func (a *assembler) symbols() []symbolEntry {
+	entries := []symbolEntry{}
+	for name, val := range a.sym {
+		if strings.HasPrefix(name, "+") || strings.HasPrefix(name, "-") {
+			// Anonymous labels don't have names worth exporting
+			continue
+		}
+		kind := "label"
+		if _, found := a.constants[name]; found {
+			kind = "constant"
+		}
+		pos := a.defs[name]
+		entries = append(entries, symbolEntry{
+			Name:   name,
+			Value:  val,
+			Kind:   kind,
+			File:   pos.File,
+			Line:   pos.Line,
+			Column: pos.Col,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// writeViceLabels writes the symbols in the format the VICE monitor loads
+// with the ll command:
+//
+//	al C:c000 .start
+//
+// Symbols with values that aren't 16 bit addresses are left out.
+func (a *assembler) writeViceLabels(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, s := range a.symbols() {
+		if s.Value < 0 || s.Value > 0xffff {
+			continue
+		}
+		fmt.Fprintf(bw, "al C:%04x .%s\n", s.Value, s.Name)
+	}
+	return bw.Flush()
+}
+
+// writeSymbolText writes the symbols one per line, sorted by name:
+//
+//	SCREEN                   $0400  constant
+//	start                    $C000  label
+func (a *assembler) writeSymbolText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, s := range a.symbols() {
+		val := fmt.Sprintf("$%04X", s.Value)
+		if s.Value < 0 {
+			val = fmt.Sprintf("%d", s.Value)
+		}
+		fmt.Fprintf(bw, "%-24s %5s  %s\n", s.Name, val, s.Kind)
+	}
+	return bw.Flush()
+}
+
+// writeSymbolJSON writes the symbols as a JSON array, including where each one
+// was defined.
+func (a *assembler) writeSymbolJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(a.symbols())
+}
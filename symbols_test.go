@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func assembleSymbols(t *testing.T) assembler {
+	src := ` .ORG $c000
+start: LDA #0
+SCREEN = $0400
+OFFSET = -2
+loop: STA SCREEN
+`
+	a := assembler{file: "demo.asm"}
+	err := a.parseReader(strings.NewReader(src))
+	require.Nil(t, err)
+	_, err = a.binaryImage()
+	require.Nil(t, err)
+	return a
+}
+
+func TestViceLabels(t *testing.T) {
+	a := assembleSymbols(t)
+	var out strings.Builder
+	require.Nil(t, a.writeViceLabels(&out))
+	require.Equal(t, `al C:0400 .SCREEN
+al C:c002 .loop
+al C:c000 .start
+`, out.String())
+}
+
+func TestSymbolText(t *testing.T) {
+	a := assembleSymbols(t)
+	var out strings.Builder
+	require.Nil(t, a.writeSymbolText(&out))
+	require.Equal(t, `OFFSET                      -2  constant
+SCREEN                   $0400  constant
+loop                     $C002  label
+start                    $C000  label
+`, out.String())
+}
+
+func TestSymbolJSON(t *testing.T) {
+	a := assembleSymbols(t)
+	var out strings.Builder
+	require.Nil(t, a.writeSymbolJSON(&out))
+	var entries []symbolEntry
+	require.Nil(t, json.Unmarshal([]byte(out.String()), &entries))
+	require.Len(t, entries, 4)
+	require.Equal(t, symbolEntry{
+		Name:   "SCREEN",
+		Value:  0x400,
+		Kind:   "constant",
+		File:   "demo.asm",
+		Line:   3,
+		Column: 1,
+	}, entries[1])
+	require.Equal(t, "label", entries[3].Kind)
+	require.Contains(t, out.String(), `"name": "start"`)
+}